@@ -0,0 +1,296 @@
+package press
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+
+	"github.com/id01/rclone-compression/format"
+)
+
+/*** BGZF ***/
+// BGZF (blocked gzip, as used by htslib, samtools and bgzip) is a series of gzip members, each with a "BC" extra subfield
+// holding the size of the member, followed by an empty end-of-file member. See the SAM/BAM format specification.
+// Files compressed in BGZF mode are genuine BGZF files, so block data and footer are only written to a sidecar index.
+// They (and BGZF files from other tools) can be opened without one, since the size of each block is in its header.
+const bgzfMaxBlockSize = 65280 // Maximum uncompressed size of a block. This is what htslib uses, so that compressed blocks always fit in 64KB.
+const bgzfMaxCompressedSize = 65536
+const bgzfHeaderSize = 18 // Size of a BGZF gzip header with only the BC subfield
+const bgzfFooterSize = 8 // CRC-32 and uncompressed size of a gzip member
+
+// Empty gzip member at the end of every BGZF file
+var bgzfEOF = []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0x1b, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// Error returned for blocks that aren't BGZF blocks
+var errNotBgzf = errors.New("Not a BGZF block")
+
+// Function that compresses a block to a BGZF block
+func (c *Compression) compressBlockBgzf(in []byte, out io.Writer, compressionLevel int) (compressedSize uint64, uncompressedSize int64, err error) {
+	if len(in) > bgzfMaxBlockSize {
+		return 0, 0, errors.New("Block size is too large for BGZF")
+	}
+
+	// Write header (with the block size filled in later), deflate data and footer
+	var b bytes.Buffer
+	b.Write(bgzfEOF[:bgzfHeaderSize])
+	flateWriter, err := flate.NewWriter(&b, compressionLevel)
+	if err != nil {
+		return 0, 0, err
+	}
+	flateWriter.Write(in)
+	err = flateWriter.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	b.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(in)))
+	b.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(in))))
+
+	// Fill in BSIZE (size of the block minus 1), write and return
+	block := b.Bytes()
+	if len(block) > bgzfMaxCompressedSize {
+		return 0, 0, errors.New("Compressed block is too large for BGZF")
+	}
+	binary.LittleEndian.PutUint16(block[16:18], uint16(len(block)-1))
+	_, err = out.Write(block)
+	return uint64(len(block)), int64(len(in)), err
+}
+
+// Gets the size of a BGZF block from the start of its header, or errNotBgzf if it isn't a BGZF block
+func bgzfBlockSize(header []byte) (int64, error) {
+	if len(header) < bgzfHeaderSize || !bytes.HasPrefix(header, gzipMagic) || header[2] != 8 || header[3]&4 == 0 {
+		return 0, errNotBgzf
+	}
+
+	// Find the BC subfield in the extra field
+	extraLen := int(binary.LittleEndian.Uint16(header[10:12]))
+	extra := header[12:]
+	if len(extra) > extraLen {
+		extra = extra[:extraLen]
+	}
+	for len(extra) >= 4 {
+		subfieldLen := int(binary.LittleEndian.Uint16(extra[2:4]))
+		if extra[0] == 'B' && extra[1] == 'C' && subfieldLen == 2 && len(extra) >= 6 {
+			blockSize := int64(binary.LittleEndian.Uint16(extra[4:6])) + 1
+			if blockSize < int64(12+extraLen+bgzfFooterSize) {
+				return 0, errNotBgzf
+			}
+			return blockSize, nil
+		}
+		if len(extra) < 4+subfieldLen {
+			break
+		}
+		extra = extra[4+subfieldLen:]
+	}
+	return 0, errNotBgzf
+}
+
+// Gets the size of the BGZF block at pos, given the start of its header. If the BC subfield comes after other subfields
+// that don't fit, the whole header is read.
+func bgzfBlockSizeAt(in io.ReadSeeker, pos int64, header []byte) (int64, error) {
+	blockSize, err := bgzfBlockSize(header)
+	if err == nil || len(header) < 12 || 12+int(binary.LittleEndian.Uint16(header[10:12])) <= len(header) {
+		return blockSize, err
+	}
+	header = make([]byte, 12+int(binary.LittleEndian.Uint16(header[10:12])))
+	in.Seek(pos, io.SeekStart)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return 0, errNotBgzf
+	}
+	return bgzfBlockSize(header)
+}
+
+// Whether a file ends with the BGZF end-of-file marker
+func hasBgzfEOF(in io.ReadSeeker, size int64) bool {
+	if size < int64(len(bgzfEOF)) {
+		return false
+	}
+	marker := make([]byte, len(bgzfEOF))
+	in.Seek(size-int64(len(marker)), io.SeekStart)
+	_, err := io.ReadFull(in, marker)
+	return err == nil && bytes.Equal(marker, bgzfEOF)
+}
+
+// Whether a file starts with a BGZF block
+func startsWithBgzfBlock(in io.ReadSeeker) bool {
+	header := make([]byte, bgzfHeaderSize)
+	in.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(in, header); err != nil {
+		return false
+	}
+	_, err := bgzfBlockSizeAt(in, 0, header)
+	return err == nil
+}
+
+/*** GZI INDEX ***/
+// A .gzi index (as written by bgzip -i) is a uint64 number of entries, followed by the uint64 compressed and uncompressed
+// offsets of the start of every block except for the first. All numbers are little endian.
+
+// Writes a .gzi index for blocks
+func writeGzi(out io.Writer, idx *format.Index) error {
+	numEntries := 0
+	if len(idx.BlockSizes) > 0 {
+		numEntries = len(idx.BlockSizes) - 1
+	}
+	gzi := binary.LittleEndian.AppendUint64(nil, uint64(numEntries))
+	var compressedStart, uncompressedStart uint64
+	for i := 0; i < numEntries; i++ {
+		compressedStart += idx.BlockSizes[i]
+		uncompressedStart += idx.UncompressedSizes[i]
+		gzi = binary.LittleEndian.AppendUint64(gzi, compressedStart)
+		gzi = binary.LittleEndian.AppendUint64(gzi, uncompressedStart)
+	}
+	_, err := out.Write(gzi)
+	return err
+}
+
+// Reads a .gzi index, returning the compressed and uncompressed start of each block (including the first)
+func readGzi(in io.Reader) (blockStarts []int64, uncompressedStarts []int64, err error) {
+	header := make([]byte, 8)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return nil, nil, err
+	}
+	numEntries := binary.LittleEndian.Uint64(header)
+	blockStarts = []int64{0}
+	uncompressedStarts = []int64{0}
+	entry := make([]byte, 16)
+	for i := uint64(0); i < numEntries; i++ {
+		if _, err = io.ReadFull(in, entry); err != nil {
+			return nil, nil, err
+		}
+		blockStart, uncompressedStart := int64(binary.LittleEndian.Uint64(entry[0:8])), int64(binary.LittleEndian.Uint64(entry[8:16]))
+		if blockStart <= blockStarts[len(blockStarts)-1] || uncompressedStart < uncompressedStarts[len(uncompressedStarts)-1] {
+			return nil, nil, errors.New("Entries of .gzi index are out of order")
+		}
+		blockStarts = append(blockStarts, blockStart)
+		uncompressedStarts = append(uncompressedStarts, uncompressedStart)
+	}
+	return blockStarts, uncompressedStarts, nil
+}
+
+/*** BGZF DECOMPRESSION ***/
+// Finds the blocks of a BGZF file by reading the header and uncompressed size of each block. Takes 1 read per block.
+func scanBgzfBlocks(in io.ReadSeeker, size int64) (blockStarts []int64, uncompressedStarts []int64, err error) {
+	// The uncompressed size at the end of each block is read together with the header of the next block
+	buf := make([]byte, 4+bgzfHeaderSize)
+	in.Seek(0, io.SeekStart)
+	n, err := io.ReadFull(in, buf[4:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, nil, err
+	}
+	header := buf[4:4+n]
+	blockStarts = []int64{0}
+	uncompressedStarts = []int64{0}
+	for pos := int64(0); pos < size; {
+		blockSize, err := bgzfBlockSizeAt(in, pos, header)
+		if err != nil {
+			return nil, nil, err
+		}
+		next := pos + blockSize
+		if next > size {
+			return nil, nil, errors.New("BGZF block is larger than file; file may be truncated")
+		}
+		readLen := int64(len(buf))
+		if size-next < bgzfHeaderSize {
+			readLen = 4 + size - next
+		}
+		in.Seek(next-4, io.SeekStart)
+		if _, err = io.ReadFull(in, buf[:readLen]); err != nil {
+			return nil, nil, err
+		}
+		blockStarts = append(blockStarts, next)
+		uncompressedStarts = append(uncompressedStarts, uncompressedStarts[len(uncompressedStarts)-1]+int64(binary.LittleEndian.Uint32(buf[:4])))
+		header = buf[4:readLen]
+		pos = next
+	}
+	return blockStarts, uncompressedStarts, nil
+}
+
+// Finds the blocks of a BGZF file from its .gzi index. The end-of-file marker (if there is one) is its own block.
+func gziBgzfBlocks(in io.ReadSeeker, size int64, gzi io.Reader) (blockStarts []int64, uncompressedStarts []int64, err error) {
+	entryBlockStarts, entryUncompressedStarts, err := readGzi(gzi)
+	if err != nil {
+		return nil, nil, err
+	}
+	dataEnd := size
+	hasEOF := hasBgzfEOF(in, size)
+	if hasEOF {
+		dataEnd -= int64(len(bgzfEOF))
+	}
+
+	// Take the blocks in the index before the end-of-file marker
+	blockStarts = []int64{0}
+	uncompressedStarts = []int64{0}
+	for i := 1; i < len(entryBlockStarts) && entryBlockStarts[i] < dataEnd; i++ {
+		blockStarts = append(blockStarts, entryBlockStarts[i])
+		uncompressedStarts = append(uncompressedStarts, entryUncompressedStarts[i])
+	}
+
+	// The index doesn't say where the last block ends, so get its uncompressed size from its footer
+	if dataEnd > 0 {
+		isize := make([]byte, 4)
+		in.Seek(dataEnd-4, io.SeekStart)
+		if _, err = io.ReadFull(in, isize); err != nil {
+			return nil, nil, err
+		}
+		blockStarts = append(blockStarts, dataEnd)
+		uncompressedStarts = append(uncompressedStarts, uncompressedStarts[len(uncompressedStarts)-1]+int64(binary.LittleEndian.Uint32(isize)))
+	}
+	if hasEOF {
+		blockStarts = append(blockStarts, size)
+		uncompressedStarts = append(uncompressedStarts, uncompressedStarts[len(uncompressedStarts)-1])
+	}
+	return blockStarts, uncompressedStarts, nil
+}
+
+// Initializes decompressor for a BGZF file without block data. Blocks are found from the .gzi index if gzi isn't nil,
+// or by reading the header of every block otherwise.
+func (d *Decompressor) initBgzf(c *Compression, in io.ReadSeeker, size int64, gzi io.Reader) error {
+	var err error
+	d.c, err = newCompression(BGZF, bgzfMaxBlockSize, c.HeuristicBytes, c.NumThreads, c.MaxCompressionRatio)
+	if err != nil {
+		return err
+	}
+
+	// Find blocks
+	if gzi != nil {
+		d.blockStarts, d.uncompressedStarts, err = gziBgzfBlocks(in, size, gzi)
+	} else {
+		d.blockStarts, d.uncompressedStarts, err = scanBgzfBlocks(in, size)
+	}
+	if err != nil {
+		return err
+	}
+	d.numBlocks = uint64(len(d.blockStarts) - 1)
+	d.decompressedSize = d.uncompressedStarts[d.numBlocks]
+	d.blockFlags = nil
+	d.checksums = nil
+	d.hashes = make(map[HashType][]byte)
+	d.metadata = nil
+
+	// Initialize cursor position and copy over reader
+	d.cursorPos = new(int64)
+	in.Seek(0, io.SeekStart)
+	d.in = in
+	return nil
+}
+
+// Opens a BGZF file (such as one written by bgzip or samtools) using its .gzi index, so that the header of every block
+// doesn't have to be read. If gzi is nil, this is the same as Open.
+func OpenBgzf(in io.ReadSeeker, size int64, gzi io.Reader) (*Decompressor, error) {
+	if gzi == nil {
+		return Open(in, size)
+	}
+	c, err := NewCompressionAdvanced(BGZF, bgzfMaxBlockSize, 1048576, 12, 0.9)
+	if err != nil {
+		return nil, err
+	}
+	decompressor := new(Decompressor)
+	err = decompressor.initBgzf(c, in, size, gzi)
+	if err != nil {
+		return nil, err
+	}
+	return decompressor, nil
+}
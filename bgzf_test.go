@@ -0,0 +1,135 @@
+package press
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"testing"
+)
+
+// Checks that a file is a plain gzip stream of data that ends with the BGZF end-of-file marker
+func checkBgzfFile(t *testing.T, compressed []byte, data []byte) {
+	if !bytes.HasSuffix(compressed, bgzfEOF) {
+		t.Fatal("Compressed file doesn't end with the BGZF end-of-file marker")
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Compressed file isn't a plain gzip stream of the original data")
+	}
+}
+
+var bgzfModeTest = containerModeTest{"bgzf", 0, BGZF, checkBgzfFile}
+
+func TestBgzf(t *testing.T) {
+	comp, err := NewCompressionPreset("bgzf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(1000000)
+	var compressed, gzi bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{GziWriter: &gzi})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every block should be found by scanning block headers, and it should open with the .gzi index too
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.numBlocks != uint64(len(data)/bgzfMaxBlockSize+2) {
+		t.Fatalf("Opened with %d blocks", d.numBlocks)
+	}
+	d, err = OpenBgzf(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), bytes.NewReader(gzi.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+
+	// Incompressible blocks should still be BGZF blocks
+	random := make([]byte, 200000)
+	for i := range random {
+		random[i] = byte(crc32.ChecksumIEEE([]byte{byte(i), byte(i >> 8), byte(i >> 16)}))
+	}
+	compressed.Reset()
+	if err = comp.CompressFile(bytes.NewReader(random), int64(len(random)), &compressed); err != nil {
+		t.Fatal(err)
+	}
+	d, err = Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, random)
+
+	// Blocks larger than BGZF allows should be rejected
+	comp.BlockSize = 1 << 20
+	if err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed); err == nil {
+		t.Fatal("Compressing BGZF blocks larger than 65280 bytes should fail")
+	}
+}
+
+// Writes a BGZF block like other tools might, with an extra subfield before the BC subfield
+func writeThirdPartyBgzfBlock(t *testing.T, out *bytes.Buffer, data []byte) {
+	var deflated bytes.Buffer
+	flateWriter, _ := flate.NewWriter(&deflated, flate.BestCompression)
+	flateWriter.Write(data)
+	flateWriter.Close()
+	header := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 3, 12, 0, 'X', 'Y', 2, 0, 0, 0, 'B', 'C', 2, 0}
+	blockSize := len(header) + 2 + deflated.Len() + bgzfFooterSize
+	out.Write(header)
+	out.Write(binary.LittleEndian.AppendUint16(nil, uint16(blockSize - 1)))
+	out.Write(deflated.Bytes())
+	out.Write(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(data)))
+	out.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(data))))
+}
+
+func TestThirdPartyBgzf(t *testing.T) {
+	// Blocks of varying sizes, with a .gzi index like bgzip -i writes
+	data := makeTestData(300000)
+	var file, gzi bytes.Buffer
+	var entries []byte
+	numEntries := uint64(0)
+	for start, i := 0, 0; start < len(data); i++ {
+		end := start + 10000 + i*3000
+		if end > len(data) {
+			end = len(data)
+		}
+		if start > 0 {
+			entries = binary.LittleEndian.AppendUint64(entries, uint64(file.Len()))
+			entries = binary.LittleEndian.AppendUint64(entries, uint64(start))
+			numEntries++
+		}
+		writeThirdPartyBgzfBlock(t, &file, data[start:end])
+		start = end
+	}
+	gzi.Write(binary.LittleEndian.AppendUint64(nil, numEntries))
+	gzi.Write(entries)
+	withoutEOF := append([]byte{}, file.Bytes()...)
+	file.Write(bgzfEOF)
+
+	for _, compressed := range [][]byte{file.Bytes(), withoutEOF} {
+		d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRandomAccess(t, d, data)
+		d, err = OpenBgzf(bytes.NewReader(compressed), int64(len(compressed)), bytes.NewReader(gzi.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRandomAccess(t, d, data)
+	}
+
+	// Appending should keep the file a BGZF file
+	checkContainerAppend(t, bgzfModeTest, file.Bytes(), data)
+}
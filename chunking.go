@@ -0,0 +1,147 @@
+package press
+
+import (
+	"io"
+	"bytes"
+	"bufio"
+	"errors"
+)
+
+// Block splitting modes
+const (
+	SPLIT_FIXED = iota // Split blocks every BlockSize bytes
+	SPLIT_CONTENT_DEFINED = iota // Split blocks at content-defined boundaries (FastCDC), so that inserting data only changes nearby blocks
+)
+
+// Switches a Compression object to content-defined block boundaries. Blocks will be between min and max bytes long
+// (except for the last one), and avg bytes long on average. BlockSize is set to max.
+func (c *Compression) SetContentDefinedChunking(min uint32, avg uint32, max uint32) error {
+	if min == 0 || min >= avg || avg >= max {
+		return errors.New("Block sizes for content-defined chunking must satisfy 0 < min < avg < max")
+	}
+	c.SplitMode = SPLIT_CONTENT_DEFINED
+	c.MinBlockSize = min
+	c.AvgBlockSize = avg
+	c.BlockSize = max
+	return nil
+}
+
+// Splits input into blocks
+type blockSplitter interface {
+	// Gets the next block. Returns io.EOF along with the last block (which may be empty).
+	nextBlock() ([]byte, error)
+}
+
+// Creates a block splitter for the current split mode
+func (c *Compression) newBlockSplitter(in io.Reader) blockSplitter {
+	if c.SplitMode == SPLIT_CONTENT_DEFINED {
+		return newContentDefinedSplitter(in, c.MinBlockSize, c.AvgBlockSize, c.BlockSize)
+	}
+	return &fixedSplitter{in, int64(c.BlockSize)}
+}
+
+/*** FIXED-SIZE BLOCKS ***/
+type fixedSplitter struct {
+	in io.Reader
+	blockSize int64
+}
+
+func (s *fixedSplitter) nextBlock() ([]byte, error) {
+	var inputBuffer bytes.Buffer
+	_, err := io.CopyN(&inputBuffer, s.in, s.blockSize)
+	return inputBuffer.Bytes(), err
+}
+
+/*** CONTENT-DEFINED BLOCKS ***/
+// Gear table for the rolling hash. This must never change, or block boundaries will move between versions.
+var gearTable = makeGearTable()
+
+// Generates the gear table using splitmix64 with a fixed seed
+func makeGearTable() (table [256]uint64) {
+	state := uint64(0x7072657373636463) // "presscdc"
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+type contentDefinedSplitter struct {
+	in *bufio.Reader
+	min int
+	avg int
+	max int
+	maskS uint64 // Mask used before avg bytes (harder to match, so blocks are less likely to be small)
+	maskL uint64 // Mask used after avg bytes (easier to match, so blocks are less likely to be large)
+}
+
+// Creates a mask with the top n bits set. The gear hash shifts left, so the top bits depend on the most bytes.
+func topBitsMask(n uint) uint64 {
+	return ^uint64(0) << (64-n)
+}
+
+func newContentDefinedSplitter(in io.Reader, min uint32, avg uint32, max uint32) *contentDefinedSplitter {
+	s := new(contentDefinedSplitter)
+	s.in = bufio.NewReaderSize(in, int(max))
+	s.min = int(min)
+	s.avg = int(avg)
+	s.max = int(max)
+	bits := uint(0) // log2 of avg
+	for (1 << (bits+1)) <= avg {
+		bits++
+	}
+	s.maskS = topBitsMask(bits+1)
+	s.maskL = topBitsMask(bits-1)
+	return s
+}
+
+// Finds the length of the next block in data using normalized chunking from FastCDC
+func (s *contentDefinedSplitter) cutPoint(data []byte) int {
+	if len(data) <= s.min {
+		return len(data)
+	}
+	end := len(data)
+	if end > s.max {
+		end = s.max
+	}
+	avg := s.avg
+	if avg > end {
+		avg = end
+	}
+	hash := uint64(0)
+	i := s.min
+	for ; i < avg; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&s.maskS == 0 {
+			return i+1
+		}
+	}
+	for ; i < end; i++ {
+		hash = (hash << 1) + gearTable[data[i]]
+		if hash&s.maskL == 0 {
+			return i+1
+		}
+	}
+	return end
+}
+
+func (s *contentDefinedSplitter) nextBlock() ([]byte, error) {
+	// Look at up to max bytes. If we get less, we are at the end of the input.
+	data, err := s.in.Peek(s.max)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	reachedEOF := len(data) < s.max
+
+	// Find the cut point and consume the block
+	cut := s.cutPoint(data)
+	block := append([]byte{}, data[:cut]...)
+	s.in.Discard(cut)
+	if reachedEOF && cut == len(data) {
+		return block, io.EOF
+	}
+	return block, nil
+}
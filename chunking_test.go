@@ -0,0 +1,61 @@
+package press
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Compresses test data using content-defined chunking
+func compressTestDataCDC(t *testing.T, data []byte) []byte {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = comp.SetContentDefinedChunking(16384, 65536, 262144)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+func TestContentDefinedChunking(t *testing.T) {
+	data := makeTestData(2000000)
+	compressed := compressTestDataCDC(t, data)
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := uint64(0); i < d.numBlocks-1; i++ {
+		blockSize := d.uncompressedStarts[i+1] - d.uncompressedStarts[i]
+		if blockSize < 16384 || blockSize > 262144 {
+			t.Fatalf("Block %d has size %d, which is out of range", i, blockSize)
+		}
+	}
+	checkRandomAccess(t, d, data)
+
+	// Insert a byte near the start; most blocks should stay the same
+	inserted := append(append(append([]byte{}, data[:1000]...), 'x'), data[1000:]...)
+	compressed2 := compressTestDataCDC(t, inserted)
+	d2, err := Open(bytes.NewReader(compressed2), int64(len(compressed2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksums := make(map[uint32]bool)
+	for _, checksum := range d.checksums {
+		checksums[checksum] = true
+	}
+	unchanged := 0
+	for _, checksum := range d2.checksums {
+		if checksums[checksum] {
+			unchanged++
+		}
+	}
+	if unchanged < len(d2.checksums)-2 {
+		t.Fatalf("Only %d out of %d blocks are unchanged after inserting a byte", unchanged, len(d2.checksums))
+	}
+}
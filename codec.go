@@ -0,0 +1,505 @@
+package press
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/id01/rclone-compression/format"
+)
+
+/*** CODEC INTERFACE ***/
+// A codec compresses and decompresses single blocks. Each compression mode is a registered codec, so different
+// compression levels of the same format are different codecs that share the same ID.
+type Codec interface {
+	ID() uint8 // Stable codec ID stored in the file footer. Codecs with the same ID must be able to decompress each other's blocks.
+	Name() string // Name of the codec (such as "gzip-default")
+	Extension() string // File extension of compressed files (such as ".gz")
+	// Compresses a block, returning the size of the compressed block and the size of the block that was compressed
+	CompressBlock(c *Compression, in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error)
+	// Decompresses a block, returning the size of the decompressed block
+	DecompressBlock(c *Compression, in io.Reader, out io.Writer) (n int, err error)
+	Capabilities() CodecCapabilities
+}
+
+// What a codec can do, and what it needs
+type CodecCapabilities struct {
+	MagicBytes bool // Whether compressed blocks start with magic bytes, so that they can't be mistaken for blocks of another codec
+	Binary string // Name of the binary the codec may use. Its path is looked up when creating a Compression and stored in BinPath.
+	BinaryRequired bool // Whether the binary is needed to compress (it is never needed to decompress)
+}
+
+// Optional interface for codecs whose compressed blocks make up a complete file of their own format (such as BGZF).
+// Their blocks are never stored uncompressed, and block data and footer are only written to a sidecar index, so that
+// files stay valid in that format. FileHeader is written before the first block, as part of it. BlockInfo is called with
+// every compressed block (the first one may start with the file header), and FinishFile is called after the last block
+// with the info of every block to write the end of the file.
+type StandaloneCodec interface {
+	Codec
+	FileHeader(c *Compression) []byte
+	BlockInfo(c *Compression, block []byte) (uint64, error)
+	FinishFile(c *Compression, idx *format.Index, blockInfo []uint64, out io.Writer, opts *CompressOptions) error
+}
+
+// Implements FileHeader and BlockInfo for standalone codecs that only need block sizes to finish a file
+type noBlockInfo struct{}
+
+func (noBlockInfo) FileHeader(c *Compression) []byte { return nil }
+func (noBlockInfo) BlockInfo(c *Compression, block []byte) (uint64, error) { return 0, nil }
+
+/*** CODEC REGISTRY ***/
+var codecs = make(map[int]Codec) // Codecs by compression mode
+var codecModesByID = make(map[uint8]int) // Compression mode used to decompress each codec ID
+var codecModesByExtension = make(map[string]int) // Compression mode used to decompress each file extension
+var presets = make(map[string]preset) // Presets by name
+var codecsLock sync.RWMutex
+
+// A compression mode with a block size, created by NewCompressionPreset
+type preset struct {
+	mode int
+	blockSize uint32
+}
+
+// Error returned when a compression mode isn't registered
+var ErrUnknownMode = errors.New("Compression mode doesn't exist")
+
+// Registers a codec for a compression mode. Codec IDs and file extensions can only be shared between the levels of
+// built-in codecs (the first one registered is used to decompress), so codecs from outside the package need their own.
+func RegisterCodec(mode int, codec Codec) error {
+	if codec.ID() == 0 {
+		return errors.New("Codec ID 0 is reserved")
+	}
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if _, ok := codecs[mode]; ok {
+		return errors.New("Compression mode is already registered")
+	}
+	idMode, idTaken := codecModesByID[codec.ID()]
+	if idTaken && !(isBuiltinCodec(codec) && isBuiltinCodec(codecs[idMode])) {
+		return errors.New("Codec ID is already registered by another codec")
+	}
+	extensionMode, extensionTaken := codecModesByExtension[codec.Extension()]
+	if extensionTaken && !(isBuiltinCodec(codec) && isBuiltinCodec(codecs[extensionMode])) {
+		return errors.New("File extension is already registered by another codec")
+	}
+	codecs[mode] = codec
+	if !idTaken {
+		codecModesByID[codec.ID()] = mode
+	}
+	if !extensionTaken {
+		codecModesByExtension[codec.Extension()] = mode
+	}
+	return nil
+}
+
+// Registers a preset for NewCompressionPreset
+func RegisterPreset(name string, mode int, blockSize uint32) error {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	if _, ok := presets[name]; ok {
+		return errors.New("Preset is already registered")
+	}
+	presets[name] = preset{mode, blockSize}
+	return nil
+}
+
+// Gets the codec for a compression mode
+func getCodec(mode int) (Codec, error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	codec, ok := codecs[mode]
+	if !ok {
+		return nil, ErrUnknownMode
+	}
+	return codec, nil
+}
+
+// Gets a preset by name
+func getPreset(name string) (preset, bool) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	p, ok := presets[name]
+	return p, ok
+}
+
+/*** BUILT-IN CODECS ***/
+// Fields shared by the codecs in this package
+type builtinCodec struct {
+	id uint8
+	name string
+	extension string
+	capabilities CodecCapabilities
+}
+
+func (b *builtinCodec) ID() uint8 { return b.id }
+func (b *builtinCodec) Name() string { return b.name }
+func (b *builtinCodec) Extension() string { return b.extension }
+func (b *builtinCodec) Capabilities() CodecCapabilities { return b.capabilities }
+func (b *builtinCodec) builtin() {}
+
+// Whether a codec is one of the built-in codecs
+func isBuiltinCodec(codec Codec) bool {
+	_, ok := codec.(interface{ builtin() })
+	return ok
+}
+
+// gzip, with a compression level
+type gzipCodec struct {
+	builtinCodec
+	level int
+}
+
+func (g *gzipCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockGz(in, out, g.level)
+}
+func (g *gzipCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockRangeGz(in, out)
+}
+
+// gzip with an exhaustive deflate encoder (see deflate.go). Much slower to compress, but decompresses like any gzip.
+type gzipOptimalCodec struct {
+	builtinCodec
+}
+
+func (g *gzipOptimalCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockGzOptimal(in, out)
+}
+func (g *gzipOptimalCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockRangeGz(in, out)
+}
+
+// BGZF blocks (see bgzf.go), with a compression level
+type bgzfCodec struct {
+	builtinCodec
+	noBlockInfo
+	level int
+}
+
+func (b *bgzfCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockBgzf(in, out, b.level)
+}
+func (b *bgzfCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockRangeGz(in, out)
+}
+
+// Writes the BGZF end-of-file marker, and a .gzi index if requested
+func (b *bgzfCodec) FinishFile(c *Compression, idx *format.Index, blockInfo []uint64, out io.Writer, opts *CompressOptions) error {
+	if _, err := out.Write(bgzfEOF); err != nil {
+		return err
+	}
+	if opts != nil && opts.GziWriter != nil {
+		return writeGzi(opts.GziWriter, idx)
+	}
+	return nil
+}
+
+// xz stored in gzip, compressed in pure Go (or by the xz binary with the given arguments, if PreferBinary is set)
+type xzInGzCodec struct {
+	builtinCodec
+	binaryArgs []string
+}
+
+func (x *xzInGzCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	if c.useBinary() {
+		return c.compressBlockExecGz(in, out, c.BinPath, x.binaryArgs)
+	}
+	return c.compressBlockXzGz(in, out)
+}
+func (x *xzInGzCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	if c.useBinary() {
+		return decompressBlockRangeExecGz(in, out, c.BinPath, []string{"-dc"})
+	}
+	return decompressBlockRangeXzGz(in, out, c.BinPath)
+}
+
+// Blocks of a multi-block xz file (see xz.go), compressed in pure Go
+type xzCodec struct {
+	builtinCodec
+}
+
+func (x *xzCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockXz(in, out)
+}
+func (x *xzCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockXz(in, out, c.BinPath, c.PreferBinary)
+}
+
+// The stream header
+func (x *xzCodec) FileHeader(c *Compression) []byte {
+	return xzStreamHeader(xzCheckType)
+}
+
+// The unpadded size of a block, which the index needs
+func (x *xzCodec) BlockInfo(c *Compression, block []byte) (uint64, error) {
+	checkType, unpaddedSize, _, err := xzBlockSizes(block)
+	if err == nil && checkType != xzCheckType {
+		return 0, errors.New("Only xz files with CRC64 checks can be appended to")
+	}
+	return unpaddedSize, err
+}
+
+// Writes the index and stream footer
+func (x *xzCodec) FinishFile(c *Compression, idx *format.Index, blockInfo []uint64, out io.Writer, opts *CompressOptions) error {
+	_, err := out.Write(xzIndexAndFooter(blockInfo, idx.UncompressedSizes, xzCheckType))
+	return err
+}
+
+// LZ4 frames
+type lz4Codec struct {
+	builtinCodec
+}
+
+func (l *lz4Codec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockLz4(in, out)
+}
+func (l *lz4Codec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockLz4(in, out, int64(c.BlockSize))
+}
+
+// Snappy blocks in the snappy framing format. Raw snappy blocks from older versions have no magic bytes, so neither does this codec.
+type snappyCodec struct {
+	builtinCodec
+}
+
+func (s *snappyCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockSnappy(in, out)
+}
+func (s *snappyCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockSnappy(in, out)
+}
+
+// zstd, with an encoder level
+type zstdCodec struct {
+	builtinCodec
+	level zstd.EncoderLevel
+}
+
+func (z *zstdCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockZstd(in, out, z.level)
+}
+func (z *zstdCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockRangeZstd(in, out)
+}
+
+// zstd frames followed by a zstd seek table (see zstdseekable.go)
+type zstdSeekableCodec struct {
+	zstdCodec
+	noBlockInfo
+}
+
+// Writes the seek table
+func (z *zstdSeekableCodec) FinishFile(c *Compression, idx *format.Index, blockInfo []uint64, out io.Writer, opts *CompressOptions) error {
+	return writeZstdSeekTable(out, idx)
+}
+
+// brotli, with a quality
+type brotliCodec struct {
+	builtinCodec
+	quality int
+}
+
+func (b *brotliCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockBrotli(in, out, b.quality)
+}
+func (b *brotliCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockBrotli(in, out)
+}
+
+// bzip2, with a compression level for the bzip2 binary
+type bzip2Codec struct {
+	builtinCodec
+	level string
+}
+
+func (b *bzip2Codec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockBzip2(in, out, b.level)
+}
+func (b *bzip2Codec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockRangeBzip2(in, out)
+}
+
+// Raw LZMA (.lzma files)
+type lzmaCodec struct {
+	builtinCodec
+}
+
+func (l *lzmaCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	return c.compressBlockLzma(in, out)
+}
+func (l *lzmaCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	return decompressBlockLzma(in, out)
+}
+
+/*** EXTERNAL COMMAND CODEC ***/
+// Codec that pipes each block through external commands, which read from stdin and write to stdout.
+// Create it with NewExternalCodec (or NewFramedExternalCodec) and register it with RegisterCodec.
+type ExternalCodec struct {
+	id uint8 // Codec ID
+	name string // Name of codec
+	extension string // File extension
+	compressPath string // Path of compression binary
+	compressArgs []string // Arguments of compression binary
+	decompressPath string // Path of decompression binary
+	decompressArgs []string // Arguments of decompression binary
+	compressPool *workerPool // Long-lived compression processes (framed codecs only)
+	decompressPool *workerPool // Long-lived decompression processes (framed codecs only)
+}
+
+// Creates an external command codec. Commands are given as the binary followed by its arguments,
+// such as []string{"zstd", "-c", "-19"}, and binaries are looked up in PATH.
+func NewExternalCodec(id uint8, name string, extension string, compressCommand []string, decompressCommand []string) (*ExternalCodec, error) {
+	if len(compressCommand) == 0 || len(decompressCommand) == 0 {
+		return nil, errors.New("External codec commands can't be empty")
+	}
+	e := &ExternalCodec{id: id, name: name, extension: extension}
+	var err error
+	e.compressPath, err = exec.LookPath(compressCommand[0])
+	if err != nil {
+		return nil, err
+	}
+	e.decompressPath, err = exec.LookPath(decompressCommand[0])
+	if err != nil {
+		return nil, err
+	}
+	e.compressArgs = compressCommand[1:]
+	e.decompressArgs = decompressCommand[1:]
+	return e, nil
+}
+
+// Creates an external command codec whose commands keep running and process many blocks, speaking the framed protocol
+// (see workerpool.go) over stdin and stdout. Processes are started when needed and reused until the codec is closed.
+func NewFramedExternalCodec(id uint8, name string, extension string, compressCommand []string, decompressCommand []string) (*ExternalCodec, error) {
+	e, err := NewExternalCodec(id, name, extension, compressCommand, decompressCommand)
+	if err != nil {
+		return nil, err
+	}
+	e.compressPool = newWorkerPool(e.compressPath, e.compressArgs)
+	e.decompressPool = newWorkerPool(e.decompressPath, e.decompressArgs)
+	return e, nil
+}
+
+func (e *ExternalCodec) ID() uint8 { return e.id }
+func (e *ExternalCodec) Name() string { return e.name }
+func (e *ExternalCodec) Extension() string { return e.extension }
+func (e *ExternalCodec) Capabilities() CodecCapabilities { return CodecCapabilities{} }
+func (e *ExternalCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	if e.compressPool == nil {
+		return c.compressBlockExecNogz(in, out, e.compressPath, e.compressArgs)
+	}
+	compressed, err := e.compressPool.process(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := out.Write(compressed)
+	return uint64(n), int64(len(in)), err
+}
+func (e *ExternalCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	if e.decompressPool == nil {
+		return decompressBlockRangeExecNogz(in, out, e.decompressPath, e.decompressArgs)
+	}
+	var b bytes.Buffer
+	_, err := io.Copy(&b, in)
+	if err != nil {
+		return 0, err
+	}
+	decompressed, err := e.decompressPool.process(b.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return out.Write(decompressed)
+}
+
+// Shuts down the processes of a framed codec. It can't be used after that.
+func (e *ExternalCodec) Close() error {
+	if e.compressPool == nil {
+		return nil
+	}
+	err := e.compressPool.Close()
+	if err2 := e.decompressPool.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Registers built-in codecs and presets. The default level of each codec is registered first, so that it is used for decompression.
+func init() {
+	magic := CodecCapabilities{MagicBytes: true}
+	gzipLevel := func(name string, level int) *gzipCodec {
+		return &gzipCodec{builtinCodec{CodecGzip, name, ".gz", magic}, level}
+	}
+	xzInGz := func(name string, args ...string) *xzInGzCodec {
+		return &xzInGzCodec{builtinCodec{CodecXzInGz, name, ".xzgz", CodecCapabilities{MagicBytes: true, Binary: XZCommand}}, args}
+	}
+	zstdLevel := func(name string, level zstd.EncoderLevel) *zstdCodec {
+		return &zstdCodec{builtinCodec{CodecZstd, name, ".zst", magic}, level}
+	}
+	brotliQuality := func(name string, quality int) *brotliCodec {
+		return &brotliCodec{builtinCodec{CodecBrotli, name, ".br", CodecCapabilities{}}, quality}
+	}
+	bzip2Level := func(name string, level string) *bzip2Codec {
+		return &bzip2Codec{builtinCodec{CodecBzip2, name, ".bz2", CodecCapabilities{MagicBytes: true, Binary: Bzip2Command, BinaryRequired: true}}, level}
+	}
+	for _, registration := range []struct {
+		mode int
+		codec Codec
+	}{
+		{GZIP_DEFAULT, gzipLevel("gzip-default", 6)},
+		{GZIP_STORE, gzipLevel("gzip-store", 0)},
+		{GZIP_MIN, gzipLevel("gzip-min", 1)},
+		{GZIP_MAX, &gzipOptimalCodec{builtinCodec{CodecGzip, "gzip-max", ".gz", magic}}},
+		{XZ_IN_GZ, xzInGz("xz-default", "-c")},
+		{XZ_IN_GZ_MIN, xzInGz("xz-min", "-c1")},
+		{LZ4, &lz4Codec{builtinCodec{CodecLz4, "lz4", ".lz4", magic}}},
+		{SNAPPY, &snappyCodec{builtinCodec{CodecSnappy, "snappy", ".snap", CodecCapabilities{}}}},
+		{ZSTD, zstdLevel("zstd-default", zstd.SpeedDefault)},
+		{ZSTD_FAST, zstdLevel("zstd-fast", zstd.SpeedFastest)},
+		{ZSTD_MAX, zstdLevel("zstd-max", zstd.SpeedBestCompression)},
+		{BROTLI, brotliQuality("brotli-default", 6)},
+		{BROTLI_FAST, brotliQuality("brotli-fast", 1)},
+		{BROTLI_MAX, brotliQuality("brotli-max", brotli.BestCompression)},
+		{BZIP2, bzip2Level("bzip2", "9")},
+		{BZIP2_MIN, bzip2Level("bzip2-min", "1")},
+		{LZMA, &lzmaCodec{builtinCodec{CodecLzma, "lzma", ".lzma", CodecCapabilities{}}}},
+		{BGZF, &bgzfCodec{builtinCodec{CodecBgzf, "bgzf", ".bgz", magic}, noBlockInfo{}, 6}},
+		{ZSTD_SEEKABLE, &zstdSeekableCodec{zstdCodec{builtinCodec{CodecZstdSeekable, "zstd-seekable", ".zst", magic}, zstd.SpeedDefault}, noBlockInfo{}}},
+		{XZ, &xzCodec{builtinCodec{CodecXz, "xz", ".xz", CodecCapabilities{MagicBytes: true, Binary: XZCommand}}}},
+	} {
+		if err := RegisterCodec(registration.mode, registration.codec); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		preset
+	}{
+		{"gzip-store", preset{GZIP_STORE, 131070}}, // GZIP-store (dummy) compression
+		{"lz4", preset{LZ4, 262140}}, // LZ4 compression (very fast)
+		{"snappy", preset{SNAPPY, 262140}}, // Snappy compression (like LZ4, but slower and worse)
+		{"gzip-min", preset{GZIP_MIN, 131070}}, // GZIP-min compression (fast)
+		{"gzip-default", preset{GZIP_DEFAULT, 131070}}, // GZIP-default compression (medium)
+		{"gzip-max", preset{GZIP_MAX, 131070}}, // GZIP-max compression (very slow to compress, smallest gzip files)
+		{"xz-min", preset{XZ_IN_GZ_MIN, 524288}}, // XZ-min compression (slow; xz -1 with PreferBinary, otherwise only differs from xz-default by its smaller blocks)
+		{"xz-default", preset{XZ_IN_GZ, 1048576}}, // XZ-default compression (very slow; xz -6 with PreferBinary)
+		{"zstd-fast", preset{ZSTD_FAST, 262144}}, // ZSTD-fast compression (fast, better than gzip-min)
+		{"zstd-default", preset{ZSTD, 524288}}, // ZSTD-default compression (medium, close to xz with fast decompression)
+		{"zstd-max", preset{ZSTD_MAX, 1048576}}, // ZSTD-max compression (slow)
+		{"brotli-fast", preset{BROTLI_FAST, 131072}}, // Brotli-fast compression (fast, better than gzip-min for text)
+		{"brotli-default", preset{BROTLI, 262144}}, // Brotli-default compression (medium, better than gzip-max for text)
+		{"brotli-max", preset{BROTLI_MAX, 1048576}}, // Brotli-max compression (very slow)
+		{"bzip2-min", preset{BZIP2_MIN, 100000}}, // Bzip2-min compression (slow)
+		{"bzip2", preset{BZIP2, 900000}}, // Bzip2 compression (slow, good for text)
+		{"lzma", preset{LZMA, 1048576}}, // Raw LZMA compression (like xz-default, without the xz container and gzip wrapper)
+		{"bgzf", preset{BGZF, bgzfMaxBlockSize}}, // BGZF compression (gzip-default in blocks that htslib and samtools can seek)
+		{"zstd-seekable", preset{ZSTD_SEEKABLE, 524288}}, // ZSTD-default compression in the zstd seekable format
+		{"xz", preset{XZ, 1048576}}, // Like xz-default, as a multi-block .xz file that the xz binary can decompress
+	} {
+		if err := RegisterPreset(p.name, p.mode, p.blockSize); err != nil {
+			panic(err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package press
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+// Codec that stores blocks reversed, to test codecs registered from outside the built-in ones
+type reverseCodec struct{}
+
+const reverseMode = 1000
+const unregisteredMode = 1099 // Compression mode for registrations that should fail
+
+func (r reverseCodec) ID() uint8 { return 200 }
+func (r reverseCodec) Name() string { return "reverse" }
+func (r reverseCodec) Extension() string { return ".rev" }
+func (r reverseCodec) Capabilities() CodecCapabilities { return CodecCapabilities{} }
+func (r reverseCodec) CompressBlock(c *Compression, in []byte, out io.Writer) (uint64, int64, error) {
+	reversed := make([]byte, len(in))
+	for i, b := range in {
+		reversed[len(in)-1-i] = b
+	}
+	n, err := out.Write(reversed)
+	return uint64(n), int64(len(in)), err
+}
+func (r reverseCodec) DecompressBlock(c *Compression, in io.Reader, out io.Writer) (int, error) {
+	block, err := ioutil.ReadAll(in)
+	if err != nil {
+		return 0, err
+	}
+	_, _, err = r.CompressBlock(c, block, out)
+	return len(block), err
+}
+
+// The reverse codec with another codec ID and file extension
+type relabeledCodec struct {
+	reverseCodec
+	id uint8
+	extension string
+}
+
+func (r relabeledCodec) ID() uint8 { return r.id }
+func (r relabeledCodec) Extension() string { return r.extension }
+
+// Removes a codec registered by a test, so that the test registers it again when it runs again
+func unregisterCodec(mode int) {
+	codecsLock.Lock()
+	defer codecsLock.Unlock()
+	codec := codecs[mode]
+	delete(codecs, mode)
+	if codecModesByID[codec.ID()] == mode {
+		delete(codecModesByID, codec.ID())
+	}
+	if codecModesByExtension[codec.Extension()] == mode {
+		delete(codecModesByExtension, codec.Extension())
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	if _, err := getCodec(reverseMode); err != nil {
+		if err = RegisterCodec(reverseMode, reverseCodec{}); err != nil {
+			t.Fatal(err)
+		}
+		if err = RegisterPreset("reverse", reverseMode, 65536); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RegisterCodec(GZIP_DEFAULT, reverseCodec{}); err == nil {
+		t.Fatal("Registering a compression mode twice should fail")
+	}
+
+	// Codec IDs and file extensions that are taken can't be registered by another codec, or files would decompress with the wrong one
+	for _, codec := range []relabeledCodec{{id: CodecGzip, extension: ".gzrev"}, {id: 200, extension: ".rev2"}, {id: 203, extension: ".gz"}, {id: 203, extension: ".rev"}} {
+		if err := RegisterCodec(unregisteredMode, codec); err == nil {
+			t.Fatalf("Registering codec ID %d with extension %s should fail", codec.id, codec.extension)
+		}
+	}
+	if _, err := getCodec(unregisteredMode); err != ErrUnknownMode {
+		t.Fatal("Failed registration shouldn't register the compression mode")
+	}
+
+	// Compress and decompress with the registered codec
+	comp, err := NewCompressionPreset("reverse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.GetFileExtension() != ".rev" {
+		t.Fatalf("File extension is %s, expected .rev", comp.GetFileExtension())
+	}
+	data := makeTestData(300000)
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+	if mode, err := ModeFromFileExtension(".rev"); err != nil || mode != reverseMode {
+		t.Fatalf("Mode from file extension is %d (%v), expected %d", mode, err, reverseMode)
+	}
+}
+
+func TestExternalCodec(t *testing.T) {
+	if _, err := NewExternalCodec(201, "missing", ".missing", []string{"this-binary-does-not-exist"}, []string{"cat"}); err == nil {
+		t.Fatal("Creating an external codec with a missing binary should fail")
+	}
+	const externalMode = 1001
+	if _, err := getCodec(externalMode); err != nil {
+		codec, err := NewExternalCodec(201, "gzip-external", ".gzext", []string{"gzip", "-c", "-9"}, []string{"gzip", "-dc"})
+		if err != nil {
+			t.Skip("gzip binary not found")
+		}
+		if err = RegisterCodec(externalMode, codec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Codec IDs and file extensions of built-in codecs can't be taken by external codecs
+	for _, taken := range []struct {
+		id uint8
+		extension string
+	}{{CodecGzip, ".gzext2"}, {203, ".gz"}} {
+		codec, err := NewExternalCodec(taken.id, "gzip-taken", taken.extension, []string{"gzip", "-c"}, []string{"gzip", "-dc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = RegisterCodec(unregisteredMode, codec); err == nil {
+			t.Fatalf("Registering an external codec with codec ID %d and extension %s should fail", taken.id, taken.extension)
+		}
+	}
+
+	// Compress and decompress with the external codec
+	comp, err := NewCompression(externalMode, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(300000)
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+}
+
+func TestUnknownMode(t *testing.T) {
+	if _, err := NewCompression(12345, 65536); err != ErrUnknownMode {
+		t.Fatalf("Expected ErrUnknownMode, got %v", err)
+	}
+
+	// Unknown modes should result in errors instead of panics
+	comp, err := NewCompression(GZIP_DEFAULT, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp.CompressionMode = 12345
+	if comp.GetFileExtension() != "" {
+		t.Fatalf("File extension of unknown mode is %s", comp.GetFileExtension())
+	}
+	data := makeTestData(100000)
+	var compressed bytes.Buffer
+	if err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed); err == nil {
+		t.Fatal("Compressing with an unknown mode should fail")
+	}
+}
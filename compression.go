@@ -10,33 +10,26 @@ import (
 	"bytes"
 	"bufio"
 	"compress/gzip"
+	"compress/bzip2"
+	"hash"
+	"hash/crc32"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"os/exec"
+	"sort"
+	"sync"
 
+	"github.com/andybalholm/brotli"
 	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+	"github.com/id01/rclone-compression/format"
 )
 
-// Cgo lz4 binding settings
-// LZ4 Cgo Binding On
-/*
-import "github.com/id01/lz4-go"
-const LZ4Cgo = true
-*/
-// LZ4 Cgo Binding Off. Creates mock functions that will never be called so that it will compile.
-type LZ4_int interface {
-	LZ4_compressFrame(in []byte) (out []byte, err error)
-	LZ4_decompressFrame(in []byte, maxSize int64) (out []byte, err error)
-}
-type LZ4_struct struct {
-}
-func (lz4 *LZ4_struct) LZ4_compressFrame(in []byte) (out []byte, err error) {
-	return nil, nil
-}
-func (lz4 *LZ4_struct) LZ4_decompressFrame(in []byte, maxSize int64) (out []byte, err error) {
-	return nil, nil
-}
-var lz4 = new(LZ4_struct)
-const LZ4Cgo = false
-
 // Compression modes
 const (
 	GZIP_STORE = iota
@@ -47,38 +40,88 @@ const (
 	XZ_IN_GZ = iota
 	LZ4 = iota
 	SNAPPY = iota
+	ZSTD_FAST = iota
+	ZSTD = iota
+	ZSTD_MAX = iota
+	BROTLI_FAST = iota
+	BROTLI = iota
+	BROTLI_MAX = iota
+	BZIP2_MIN = iota
+	BZIP2 = iota
+	LZMA = iota
+	BGZF = iota
+	ZSTD_SEEKABLE = iota
+	XZ = iota
+)
+
+// Stable codec IDs stored in the file footer (see the format package)
+const (
+	CodecGzip = format.CodecGzip // All gzip modes
+	CodecXzInGz = format.CodecXzInGz // All xz-in-gzip modes
+	CodecLz4 = format.CodecLz4
+	CodecSnappy = format.CodecSnappy
+	CodecZstd = format.CodecZstd // All zstd modes, except for ZSTD_SEEKABLE
+	CodecBrotli = format.CodecBrotli // All brotli modes
+	CodecBzip2 = format.CodecBzip2 // All bzip2 modes
+	CodecLzma = format.CodecLzma
+	CodecBgzf = format.CodecBgzf
+	CodecXz = format.CodecXz
+	CodecZstdSeekable = format.CodecZstdSeekable
 )
 
 // Constants
 // Compression binaries
-const XZCommand = "xz" // Name of xz binary (if available)
-const LZ4Command = "lz4" // Name of lz4 binary (if available)
+const XZCommand = "xz" // Name of xz binary (optional; xz is compressed in pure Go unless PreferBinary is set)
+const Bzip2Command = "bzip2" // Name of bzip2 binary (needed to compress bzip2, but not to decompress it)
 // Debug mode
 const DEBUG = false
+// Table for CRC-32C (Castagnoli) checksums of blocks
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
 // Struct containing configurable variables (what used to be constants)
 type Compression struct {
-	CompressionMode int // Compression mode
+	CompressionMode int // Compression mode (one of the mode constants, or a mode registered with RegisterCodec)
 	BlockSize uint32 // Size of blocks. Higher block size means better compression but more download bandwidth needed for small downloads
 			 // ~1MB is recommended for xz, while ~128KB is recommended for gzip and lz4
 	HeuristicBytes int64 // Bytes to perform gzip heuristic on to determine whether a file should be compressed
 	NumThreads int // Number of threads to use for compression
 	MaxCompressionRatio float64 // Maximum compression ratio for a file to be considered compressible
-	BinPath string // Path to compression binary. This is used for all non-gzip compression.
+	BinPath string // Path to compression binary. This is used for compressing bzip2, and for xz if PreferBinary is set.
+	PreferBinary bool // Use the compression binary (if found) for xz instead of compressing in pure Go. Decompression falls back to it either way.
+	Hashes []HashType // Hashes of the uncompressed data to compute during compression and store in the file
+	SplitMode int // How to split the file into blocks (see SPLIT_FIXED and SPLIT_CONTENT_DEFINED). BlockSize is the maximum block size.
+	MinBlockSize uint32 // Minimum block size for content-defined blocks
+	AvgBlockSize uint32 // Average block size for content-defined blocks
 }
 
-// Create a Compression object with a preset mode/bs
-func NewCompressionPreset(preset string) (*Compression, error) {
-	switch preset {
-		case "gzip-store": return NewCompression(GZIP_STORE, 131070) // GZIP-store (dummy) compression
-		case "lz4": return NewCompression(LZ4, 262140) // LZ4 compression (very fast)
-		case "snappy": return NewCompression(SNAPPY, 262140) // Snappy compression (like LZ4, but slower and worse)
-		case "gzip-min": return NewCompression(GZIP_MIN, 131070) // GZIP-min compression (fast)
-		case "gzip-default": return NewCompression(GZIP_DEFAULT, 131070) // GZIP-default compression (medium)
-		case "xz-min": return NewCompression(XZ_IN_GZ_MIN, 524288) // XZ-min compression (slow)
-		case "xz-default": return NewCompression(XZ_IN_GZ, 1048576) // XZ-default compression (very slow)
+// Hashes of the whole uncompressed file that can be stored in compressed files
+type HashType uint8
+const (
+	HashMD5 HashType = 1
+	HashSHA1 HashType = 2
+	HashSHA256 HashType = 3
+)
+
+// Error returned when a hash isn't stored in a file
+var ErrHashNotStored = errors.New("Hash is not stored in file")
+
+// Creates a hasher for a hash type, or returns nil if the hash type doesn't exist
+func (h HashType) newHasher() hash.Hash {
+	switch h {
+		case HashMD5: return md5.New()
+		case HashSHA1: return sha1.New()
+		case HashSHA256: return sha256.New()
 	}
-	return nil, errors.New("Compression mode doesn't exist")
+	return nil
+}
+
+// Create a Compression object with a preset mode/bs (see RegisterPreset)
+func NewCompressionPreset(name string) (*Compression, error) {
+	p, ok := getPreset(name)
+	if !ok {
+		return nil, errors.New("Compression preset doesn't exist")
+	}
+	return NewCompression(p.mode, p.blockSize)
 }
 
 // Create a Compression object with some default configuration values
@@ -86,8 +129,25 @@ func NewCompression(mode int, bs uint32) (*Compression, error) {
 	return NewCompressionAdvanced(mode, bs, 1048576, 12, 0.9)
 }
 
-// Create a Compression object
+// Error returned when creating a Compression for a mode that can't compress without its binary (such as bzip2), and
+// the binary isn't found. Decompressing never needs a binary, so files can be decompressed with any other mode.
+var ErrBinaryNotFound = errors.New("Binary needed to compress in this mode wasn't found")
+
+// Create a Compression object. Returns ErrBinaryNotFound if the mode needs a binary to compress that isn't found.
 func NewCompressionAdvanced(mode int, bs uint32, hb int64, threads int, mcr float64) (c *Compression, err error) {
+	c, err = newCompression(mode, bs, hb, threads, mcr)
+	if err != nil {
+		return nil, err
+	}
+	codec, _ := getCodec(mode)
+	if codec.Capabilities().BinaryRequired && c.BinPath == "" {
+		return nil, ErrBinaryNotFound
+	}
+	return c, nil
+}
+
+// Create a Compression object that may not be able to compress because its binary is missing (for decompressors)
+func newCompression(mode int, bs uint32, hb int64, threads int, mcr float64) (c *Compression, err error) {
 	// Set vars
 	c = new(Compression)
 	c.CompressionMode = mode
@@ -95,14 +155,15 @@ func NewCompressionAdvanced(mode int, bs uint32, hb int64, threads int, mcr floa
 	c.HeuristicBytes = hb
 	c.NumThreads = threads
 	c.MaxCompressionRatio = mcr
-	// Get binary path if needed
-	err = nil
-	if mode == XZ_IN_GZ || mode == XZ_IN_GZ_MIN {
-		c.BinPath, err = exec.LookPath(XZCommand)
-	} else if mode == LZ4 && !LZ4Cgo {
-		c.BinPath, err = exec.LookPath(LZ4Command)
+	// Get binary path if needed. Codecs only use binaries for some operations, so it's fine if it doesn't exist.
+	codec, err := getCodec(mode)
+	if err != nil {
+		return nil, err
+	}
+	if binary := codec.Capabilities().Binary; binary != "" {
+		c.BinPath, _ = exec.LookPath(binary)
 	}
-	return c, err
+	return c, nil
 }
 
 /*** UTILITY FUNCTIONS ***/
@@ -111,20 +172,46 @@ func (c* Compression) maxCompressedBlockSize() uint32 {
 	return c.BlockSize + (c.BlockSize>>2) + 256
 }
 
-// Gets file extension for current compression mode
+// Gets file extension for current compression mode. Returns an empty string if the compression mode doesn't exist.
 func (c* Compression) GetFileExtension() string {
-	switch c.CompressionMode {
-		case GZIP_STORE: fallthrough
-		case GZIP_MIN: fallthrough
-		case GZIP_DEFAULT: fallthrough
-		case GZIP_MAX: return ".gz"
-		case XZ_IN_GZ_MIN: fallthrough
-		case XZ_IN_GZ: return ".xzgz"
-		case LZ4: return ".lz4"
-		case SNAPPY: return ".snap"
-	}
-	panic("Compression mode doesn't exist")
+	codec, err := getCodec(c.CompressionMode)
+	if err != nil {
+		return ""
+	}
+	return codec.Extension()
+}
+
+// Gets a compression mode that is able to decompress files with the given file extension
+func ModeFromFileExtension(extension string) (mode int, err error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	mode, ok := codecModesByExtension[extension]
+	if !ok {
+		return 0, &UnknownFormatError{"Unknown file extension " + extension}
+	}
+	return mode, nil
+}
+
+// Gets the stable codec ID for current compression mode. Returns 0 if the compression mode doesn't exist.
+func (c* Compression) getCodecID() uint8 {
+	codec, err := getCodec(c.CompressionMode)
+	if err != nil {
+		return 0
+	}
+	return codec.ID()
+}
+
+// Gets a compression mode that is able to decompress a codec ID
+func modeFromCodecID(codecID uint8) (mode int, err error) {
+	codecsLock.RLock()
+	defer codecsLock.RUnlock()
+	mode, ok := codecModesByID[codecID]
+	if !ok {
+		return 0, &UnknownFormatError{"Unknown codec ID in footer; file may be corrupted or from a newer version"}
+	}
+	return mode, nil
 }
+
 // Gets a file extension along with compressibility of file
 func (c* Compression) GetFileCompressionInfo(reader io.Reader) (compressable bool, extension string, err error) {
 	// Use our compression algorithm to do a heuristic on the first few bytes
@@ -148,61 +235,16 @@ func (c* Compression) GetFileCompressionInfo(reader io.Reader) (compressable boo
 	return true, c.GetFileExtension(), nil
 }
 
-/*** BYTE CONVERSION FUNCTIONS ***/
-// Converts uint16 to bytes (little endian)
-func uint16ToBytes(n uint16) []byte {
-	return []byte{byte(n&0xff), byte(n>>8)}
-}
-
-// Converts bytes to uint16 (little endian)
-func bytesToUint16(n []byte) uint16 {
-	return uint16(n[0])+(uint16(n[1])<<8)
-}
-
-// Converts uint32 to bytes (little endian)
-func uint32ToBytes(n uint32) []byte {
-	return append(uint16ToBytes(uint16(n&0xffff)), uint16ToBytes(uint16(n>>16))...)
-}
-
-// Converts bytes to uint32 (little endian)
-func bytesToUint32(n []byte) uint32 {
-	res := uint32(0)
-	for i := 3; i>=0; i-- {
-		res <<= 8
-		res += uint32(n[i])
-	}
-	return res
-}
-
-/*** BLOCK DATA SERIALIZATION FUNCTIONS ***/
-// These should be constant
-var gzipHeaderData = []byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03} // A gzip header that allows for extra data
-var gzipContentAndFooter = []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00} // Empty gzip content and footer
-// Size of gzip header and footer for gzip files that are storing block data in extra data fields
-const GzipHeaderSize = 10
-const GzipDataAndFooterSize = 10
-// Splits data into extra data in empty gzip files, followed by a gzip file storing the total length of all the prior gzip files as a uint32
-func gzipExtraify(in io.Reader, out io.Writer) {
-	// Loop through the data, splitting it into up to 65535-byte chunks, then adding it to an empty gzip file as extra data
-	totalLength := uint32(0)
-	for {
-		currGzipData := make([]byte, 65535)
-		n, err := in.Read(currGzipData) // n is the length of the extra data that will be added
-		if err == io.EOF {
-			break
-		}
-		currGzipData = append(append(gzipHeaderData, uint16ToBytes(uint16(n))...), // n bytes
-			append(currGzipData[:n], gzipContentAndFooter...)...) // Data and footer
-		totalLength += uint32(len(currGzipData))
-		out.Write(currGzipData)
-	}
-	out.Write(append(gzipHeaderData, []byte{0x04, 0x00}...)) // 4 bytes
-	out.Write(append(uint32ToBytes(totalLength), gzipContentAndFooter...))
-}
+/*** FILE FORMAT ***/
+// The on-disk layout is defined in the format package. These are kept here for compatibility.
+const GzipHeaderSize = format.GzipHeaderSize
+const GzipDataAndFooterSize = format.GzipDataAndFooterSize
+const LengthOffsetFromEnd = format.LengthOffsetFromEnd
+const TrailingBytes = format.TrailingBytes
 
 /*** BLOCK COMPRESSION FUNCTIONS ***/
 // Function that compresses a block using gzip
-func (c *Compression) compressBlockGz(in []byte, out io.Writer, compressionLevel int) (compressedSize uint32, uncompressedSize int64, err error) {
+func (c *Compression) compressBlockGz(in []byte, out io.Writer, compressionLevel int) (compressedSize uint64, uncompressedSize int64, err error) {
 	// Initialize buffer
 	bufw := bufio.NewWriterSize(out, int(c.maxCompressedBlockSize()))
 
@@ -217,30 +259,139 @@ func (c *Compression) compressBlockGz(in []byte, out io.Writer, compressionLevel
 
 	// Finalize gzip file, flush buffer and return
 	outw.Close()
-	blockSize := uint32(bufw.Buffered())
+	blockSize := uint64(bufw.Buffered())
 	bufw.Flush()
 
 	return blockSize, int64(len(in)), err
 }
 
+// Function that compresses a block using gzip with the exhaustive deflate encoder
+func (c *Compression) compressBlockGzOptimal(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	// Compress and return
+	outBytes := gzipOptimal(in)
+	_, err = out.Write(outBytes)
+	return uint64(len(outBytes)), int64(len(in)), err
+}
+
 // Function that compresses a block using lz4
-func (c *Compression) compressBlockLz4(in []byte, out io.Writer) (compressedSize uint32, uncompressedSize int64, err error) {
+func (c *Compression) compressBlockLz4(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
 	// Compress and return
-	outBytes, err := lz4.LZ4_compressFrame(in)
-	out.Write(outBytes)
-	return uint32(len(outBytes)), int64(len(in)), err
+	outBytes := lz4CompressFrame(in)
+	_, err = out.Write(outBytes)
+	return uint64(len(outBytes)), int64(len(in)), err
+}
+
+// Function that compresses a block using snappy. Each block is a complete stream in the snappy framing format
+// (stream identifier, then chunks of up to 64KB with masked CRC-32C checksums), so blocks concatenate to a valid stream.
+func (c *Compression) compressBlockSnappy(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	// Compress to buffer
+	var b bytes.Buffer
+	snappyWriter := snappy.NewBufferedWriter(&b)
+	_, err = snappyWriter.Write(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = snappyWriter.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Write and return
+	_, err = out.Write(b.Bytes())
+	return uint64(b.Len()), int64(len(in)), err
+}
+
+// zstd encoders for each encoder level. These are created when first used, and are safe to use from multiple threads.
+var zstdEncoders = make(map[zstd.EncoderLevel]*zstd.Encoder)
+var zstdEncodersLock sync.Mutex
+
+// Gets the zstd encoder for an encoder level
+func getZstdEncoder(level zstd.EncoderLevel) (*zstd.Encoder, error) {
+	zstdEncodersLock.Lock()
+	defer zstdEncodersLock.Unlock()
+	if encoder, ok := zstdEncoders[level]; ok {
+		return encoder, nil
+	}
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	zstdEncoders[level] = encoder
+	return encoder, nil
 }
 
-// Function that compresses a block using snappy
-func (c *Compression) compressBlockSnappy(in []byte, out io.Writer) (compressedSize uint32, uncompressedSize int64, err error) {
+// Function that compresses a block using zstd
+func (c *Compression) compressBlockZstd(in []byte, out io.Writer, level zstd.EncoderLevel) (compressedSize uint64, uncompressedSize int64, err error) {
+	encoder, err := getZstdEncoder(level)
+	if err != nil {
+		return 0, 0, err
+	}
+
 	// Compress and return
-	outBytes := snappy.Encode(nil, in)
+	outBytes := encoder.EncodeAll(in, make([]byte, 0, len(in)))
 	_, err = out.Write(outBytes)
-	return uint32(len(outBytes)), int64(len(in)), err
+	return uint64(len(outBytes)), int64(len(in)), err
+}
+
+// Function that compresses a block using brotli
+func (c *Compression) compressBlockBrotli(in []byte, out io.Writer, quality int) (compressedSize uint64, uncompressedSize int64, err error) {
+	// The window never needs to be larger than a block
+	lgwin := 10
+	for lgwin < 24 && 1<<uint(lgwin) - 16 < len(in) {
+		lgwin++
+	}
+
+	// Compress and return
+	var b bytes.Buffer
+	brotliWriter := brotli.NewWriterOptions(&b, brotli.WriterOptions{Quality: quality, LGWin: lgwin})
+	_, err = brotliWriter.Write(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = brotliWriter.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(out, &b)
+	return uint64(n), int64(len(in)), err
+}
+
+// Function that compresses a block using the bzip2 binary (there is no bzip2 compressor in the Go standard library)
+func (c *Compression) compressBlockBzip2(in []byte, out io.Writer, level string) (compressedSize uint64, uncompressedSize int64, err error) {
+	if c.BinPath == "" {
+		return 0, 0, errors.New("bzip2 binary not found; it is needed to compress bzip2")
+	}
+	return c.compressBlockExecNogz(in, out, c.BinPath, []string{"-c" + level})
+}
+
+// Function that compresses a block using raw LZMA in pure Go (.lzma files, without the xz container)
+func (c *Compression) compressBlockLzma(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	// The dictionary never needs to be larger than a block
+	dictCap := int(c.BlockSize)
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+
+	// Compress, storing the uncompressed size in the header so that no end marker is needed
+	var b bytes.Buffer
+	lzmaWriter, err := lzma.WriterConfig{DictCap: dictCap, SizeInHeader: true, Size: int64(len(in))}.NewWriter(&b)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = lzmaWriter.Write(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = lzmaWriter.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := io.Copy(out, &b)
+	return uint64(n), int64(len(in)), err
 }
 
 // Function that compresses a block using a shell command without wrapping in gzip. Requires an binary corresponding with the command.
-func (c *Compression) compressBlockExecNogz(in []byte, out io.Writer, binaryPath string, args []string) (compressedSize uint32, uncompressedSize int64, err error) {
+func (c *Compression) compressBlockExecNogz(in []byte, out io.Writer, binaryPath string, args []string) (compressedSize uint64, uncompressedSize int64, err error) {
 	// Initialize compression subprocess
 	subprocess := exec.Command(binaryPath, args...)
 	stdin, err := subprocess.StdinPipe()
@@ -263,11 +414,11 @@ func (c *Compression) compressBlockExecNogz(in []byte, out io.Writer, binaryPath
 	// Copy over and return
 	n, err := io.Copy(out, bytes.NewReader(output))
 
-	return uint32(n), int64(len(in)), err
+	return uint64(n), int64(len(in)), err
 }
 
 // Function that compresses a block using a shell command. Requires an binary corresponding with the command.
-func (c *Compression) compressBlockExecGz(in []byte, out io.Writer, binaryPath string, args []string) (compressedSize uint32, uncompressedSize int64, err error) {
+func (c *Compression) compressBlockExecGz(in []byte, out io.Writer, binaryPath string, args []string) (compressedSize uint64, uncompressedSize int64, err error) {
 	reachedEOF := false
 
 	// Compress without gzip wrapper
@@ -287,55 +438,192 @@ func (c *Compression) compressBlockExecGz(in []byte, out io.Writer, binaryPath s
 	return blockSize, n, err
 }
 
+// Function that compresses a block using xz in pure Go. Like compressBlockExecGz, the xz file is stored in gzip.
+// There is only one compression level in pure Go (the binary tree matcher is far too slow to be useful), so XZ_IN_GZ_MIN and
+// XZ_IN_GZ only differ by block size unless the binary is used.
+func (c *Compression) compressBlockXzGz(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	// The dictionary never needs to be larger than a block
+	dictCap := int(c.BlockSize)
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+
+	// Compress without gzip wrapper
+	var b bytes.Buffer
+	xzWriter, err := xz.WriterConfig{DictCap: dictCap, Matcher: lzma.HashTable4}.NewWriter(&b)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = xzWriter.Write(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = xzWriter.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Store in gzip and return
+	blockSize, _, err := c.compressBlockGz(b.Bytes(), out, 0)
+	return blockSize, int64(len(in)), err
+}
+
+// Whether to use the compression binary instead of compressing in pure Go
+func (c *Compression) useBinary() bool {
+	return c.PreferBinary && c.BinPath != ""
+}
+
 // Wrapper function to compress a block
-func (c* Compression) compressBlock(in []byte, out io.Writer) (compressedSize uint32, uncompressedSize int64, err error) {
-	switch c.CompressionMode { // Select compression function (and arguments) based on compression mode
-		case GZIP_STORE: return c.compressBlockGz(in, out, 0)
-		case GZIP_MIN: return c.compressBlockGz(in, out, 1)
-		case GZIP_DEFAULT: return c.compressBlockGz(in, out, 6)
-		case GZIP_MAX: return c.compressBlockGz(in, out, 9)
-		case XZ_IN_GZ: return c.compressBlockExecGz(in, out, c.BinPath, []string{"-c"})
-		case XZ_IN_GZ_MIN: return c.compressBlockExecGz(in, out, c.BinPath, []string{"-c1"})
-		case LZ4: if LZ4Cgo { 
-				return c.compressBlockLz4(in, out)
-			} else {
-				return c.compressBlockExecNogz(in, out, c.BinPath, []string{"-c"})
-			}
-		case SNAPPY: return c.compressBlockSnappy(in, out)
+func (c* Compression) compressBlock(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	codec, err := getCodec(c.CompressionMode)
+	if err != nil {
+		return 0, 0, err
 	}
-	panic("Compression mode doesn't exist")
+	return codec.CompressBlock(c, in, out)
 }
 
 /*** MAIN COMPRESSION INTERFACE ***/
 // Result of compression for a single block (gotten by a single thread)
 type CompressionResult struct {
 	buffer *bytes.Buffer
-	blockSize uint32
+	blockSize uint64
 	n int64
+	checksum uint32 // CRC-32C of the uncompressed block
+	flags uint8 // Block flags (see format.BlockFlagStored)
 	err error
 }
 
+// Options for compressing a single file
+type CompressOptions struct {
+	IndexWriter io.Writer // If set, block data and footer are written here (as a sidecar index) instead of after the compressed blocks
+	Metadata *Metadata // If set, attributes of the original file to store in the block data
+	GziWriter io.Writer // If set when compressing in BGZF mode, a .gzi index (as written by bgzip -i) is written here
+	StoreIncompressibleBlocks bool // If set, blocks that don't compress below MaxCompressionRatio are stored uncompressed (see format.BlockFlagStored)
+}
+
 // Compresses a file. Argument "size" is ignored.
 func (c *Compression) CompressFile(in io.Reader, size int64, out io.Writer) error {
+	return c.CompressFileWithOptions(in, size, out, nil)
+}
+
+// Block data that is built up while compressing blocks
+type blockDataBuilder struct {
+	index format.Index // Block data
+	missingChecksums bool // Whether some blocks don't have checksums (in which case none are stored)
+	hasBlockFlags bool // Whether any block has flags
+	decompressedSize uint64 // Total uncompressed size of blocks
+	hashers []hash.Hash // Hashers for the whole uncompressed file
+	hashWriter io.Writer // Writer that writes to all hashers
+	blockInfo []uint64 // Info of every block, for standalone codecs
+}
+
+// Creates a block data builder, with hashers for the hashes we are configured to compute
+func (c *Compression) newBlockDataBuilder() (*blockDataBuilder, error) {
+	b := new(blockDataBuilder)
+	b.hashers = make([]hash.Hash, len(c.Hashes))
+	hashWriters := make([]io.Writer, len(c.Hashes))
+	for i, hashType := range c.Hashes {
+		b.hashers[i] = hashType.newHasher()
+		if b.hashers[i] == nil {
+			return nil, errors.New("Hash type doesn't exist")
+		}
+		hashWriters[i] = b.hashers[i]
+	}
+	b.hashWriter = io.MultiWriter(hashWriters...)
+	return b, nil
+}
+
+// Adds a block to block data
+func (b *blockDataBuilder) addBlock(compressedSize uint64, uncompressedSize uint64, checksum uint32, hasChecksum bool, flags uint8) {
+	b.index.BlockSizes = append(b.index.BlockSizes, compressedSize)
+	b.index.UncompressedSizes = append(b.index.UncompressedSizes, uncompressedSize)
+	b.index.Checksums = append(b.index.Checksums, checksum)
+	b.missingChecksums = b.missingChecksums || !hasChecksum
+	b.index.BlockFlags = append(b.index.BlockFlags, flags)
+	b.hasBlockFlags = b.hasBlockFlags || flags != 0
+	b.decompressedSize += uncompressedSize
+}
+
+// Finishes block data
+func (b *blockDataBuilder) finish(c *Compression) *format.Index {
+	if b.missingChecksums {
+		b.index.Checksums = nil
+	}
+	if !b.hasBlockFlags { // Only needed if a block was stored, so that files without stored blocks can be read by older versions
+		b.index.BlockFlags = nil
+	}
+	for i, hasher := range b.hashers {
+		b.index.Hashes = append(b.index.Hashes, format.Hash{Type: uint8(c.Hashes[i]), Digest: hasher.Sum(nil)})
+	}
+	return &b.index
+}
+
+// Error returned when hashes or metadata are asked for in a standalone mode (such as BGZF) without a sidecar index.
+// Standalone modes only write block data to the sidecar index, so they would be lost.
+var ErrIndexWriterNeeded = errors.New("Hashes and metadata can only be stored in this mode with CompressOptions.IndexWriter")
+
+// Checks that the hashes and metadata of block data will be written, before anything is compressed
+func (c *Compression) checkBlockDataWritten(blockData *blockDataBuilder, opts *CompressOptions) error {
+	if (len(blockData.hashers) == 0 && blockData.index.Metadata == nil) || (opts != nil && opts.IndexWriter != nil) {
+		return nil
+	}
+	codec, err := getCodec(c.CompressionMode)
+	if err != nil {
+		return err
+	}
+	if _, ok := codec.(StandaloneCodec); ok {
+		return ErrIndexWriterNeeded
+	}
+	return nil
+}
+
+// Compresses a file with per-file options. Argument "size" is ignored. opts may be nil.
+// When a sidecar index is used, out only contains the compressed blocks. Unless opts.StoreIncompressibleBlocks is set
+// and a block was stored uncompressed, this is a plain stream of the underlying format (e.g. concatenated gzip files).
+func (c *Compression) CompressFileWithOptions(in io.Reader, size int64, out io.Writer, opts *CompressOptions) error {
 	// Initialize buffered writer
 	bufw := bufio.NewWriterSize(out, int(c.maxCompressedBlockSize()*uint32(c.NumThreads)))
 
-	// Write gzip
-	var blockData []byte = make([]byte, 0)
+	// Initialize block data
+	blockData, err := c.newBlockDataBuilder()
+	if err != nil {
+		return err
+	}
+	if opts != nil {
+		blockData.index.Metadata = opts.Metadata
+	}
+	if err = c.checkBlockDataWritten(blockData, opts); err != nil {
+		return err
+	}
+
+	// Compress blocks, then write block data and footer
+	err = c.compressBlocks(in, bufw, blockData, opts != nil && opts.StoreIncompressibleBlocks)
+	if err != nil {
+		return err
+	}
+	return c.writeBlockData(blockData, bufw, opts)
+}
+
+// Compresses blocks from in until EOF, writing them to bufw and adding them to block data. If storeIncompressible is
+// set, blocks that don't compress well enough are stored uncompressed.
+func (c *Compression) compressBlocks(in io.Reader, bufw *bufio.Writer, blockData *blockDataBuilder, storeIncompressible bool) error {
+	splitter := c.newBlockSplitter(in)
+	codec, _ := getCodec(c.CompressionMode)
+	standaloneCodec, standalone := codec.(StandaloneCodec)
 	for {
 		// Loop through threads, spawning a go procedure for each thread. If we get eof on one thread, set eofAt to that thread and break
 		compressionResults := make([]chan CompressionResult, c.NumThreads)
 		eofAt := -1
 		for i := 0; i < c.NumThreads; i++ {
-			// Create thread channel and allocate buffer to pass to thread
+			// Create thread channel and get block to pass to thread
 			compressionResults[i] = make(chan CompressionResult)
-			var inputBuffer bytes.Buffer
-			_, err := io.CopyN(&inputBuffer, in, int64(c.BlockSize))
+			inputBuffer, err := splitter.nextBlock()
 			if err == io.EOF {
 				eofAt = i
 			} else if err != nil {
 				return err
 			}
+			blockData.hashWriter.Write(inputBuffer)
 			// Run thread
 			go func(i int, in []byte){
 				// Initialize thread writer and result struct
@@ -352,14 +640,22 @@ func (c *Compression) CompressFile(in io.Reader, size int64, out io.Writer) erro
 					compressionResults[i] <- res
 					return
 				}
+				// If the block didn't compress well enough, store it uncompressed instead if asked to (unless the codec's blocks have to stay valid)
+				if storeIncompressible && !standalone && n > 0 && float64(blockSize) / float64(n) > c.MaxCompressionRatio {
+					buffer.Reset()
+					buffer.Write(in)
+					blockSize = uint64(len(in))
+					res.flags |= format.BlockFlagStored
+				}
 				// Pass our data back to the main thread as a compression result
 				res.buffer = &buffer
 				res.blockSize = blockSize
 				res.n = n
+				res.checksum = crc32.Checksum(in, crc32cTable)
 				res.err = err
 				compressionResults[i] <- res
 				return
-			}(i, inputBuffer.Bytes())
+			}(i, inputBuffer)
 			// If we have reached eof, we don't need more threads
 			if eofAt != -1 {
 				break
@@ -375,20 +671,29 @@ func (c *Compression) CompressFile(in io.Reader, size int64, out io.Writer) erro
 				if res.buffer == nil {
 					return res.err
 				}
+				// Standalone codecs may need info about the block, and write their file header as part of the first block
+				if standalone {
+					info, err := standaloneCodec.BlockInfo(c, res.buffer.Bytes())
+					if err != nil {
+						return err
+					}
+					blockData.blockInfo = append(blockData.blockInfo, info)
+					if len(blockData.index.BlockSizes) == 0 {
+						header := standaloneCodec.FileHeader(c)
+						bufw.Write(header)
+						res.blockSize += uint64(len(header))
+					}
+				}
 				io.Copy(bufw, res.buffer)
 				if DEBUG {
 					log.Printf("%d %d\n", res.n, res.blockSize)
 				}
 
-				// Append block size to block data
-				blockData = append(blockData, uint32ToBytes(res.blockSize)...)
+				// Add block to block data
+				blockData.addBlock(res.blockSize, uint64(res.n), res.checksum, true, res.flags)
 
-				// If this is the last block, add the raw size of the last block to the end of blockData and break
+				// If this is the last block, break
 				if eofAt == i {
-					if DEBUG {
-						log.Printf("%d %d %d\n", res.n, byte(res.n%256), byte(res.n/256))
-					}
-					blockData = append(blockData, uint32ToBytes(uint32(res.n))...)
 					break
 				}
 			}
@@ -402,31 +707,182 @@ func (c *Compression) CompressFile(in io.Reader, size int64, out io.Writer) erro
 			if DEBUG {
 				log.Printf("%d", eofAt)
 			}
-			break
+			return nil
 		}
 	}
+}
 
-	// Create gzip file containing block index data, stored in buffer
-	var b bytes.Buffer
-	gz := gzip.NewWriter(&b)
-	if _, err := gz.Write(blockData); err != nil {
-		panic(err)
+// Writes block data and footer after the compressed blocks in bufw (or to the sidecar index), then flushes
+func (c *Compression) writeBlockData(blockData *blockDataBuilder, bufw *bufio.Writer, opts *CompressOptions) error {
+	// Codecs whose blocks make up a complete file finish the file themselves, and only write block data to a sidecar index
+	index := blockData.finish(c)
+	hasIndexWriter := opts != nil && opts.IndexWriter != nil
+	if codec, err := getCodec(c.CompressionMode); err == nil {
+		if standalone, ok := codec.(StandaloneCodec); ok {
+			if err := standalone.FinishFile(c, index, blockData.blockInfo, bufw, opts); err != nil {
+				return err
+			}
+			if !hasIndexWriter {
+				return bufw.Flush()
+			}
+		}
 	}
-	if err := gz.Flush(); err != nil {
-		panic(err)
+
+	// Write block data and footer to end of bufw (or to the sidecar index), then flush
+	indexw := bufw
+	if hasIndexWriter {
+		indexw = bufio.NewWriter(opts.IndexWriter)
 	}
-	if err := gz.Close(); err != nil {
-		panic(err)
+	var footer format.Footer
+	footer.DecompressedSize = blockData.decompressedSize
+	footer.BlockSize = c.BlockSize
+	footer.NumBlocks = uint64(len(blockData.index.BlockSizes))
+	footer.CodecID = c.getCodecID()
+	footer.Version = format.FooterVersion
+	err := format.WriteTrailer(indexw, index, &footer)
+	if err != nil {
+		return err
+	}
+	if err := indexw.Flush(); err != nil {
+		return err
+	}
+	if err := bufw.Flush(); err != nil {
+		return err
 	}
-
-	// Append extra data gzips to end of bufw, then flush bufw
-	gzipExtraify(bytes.NewReader(b.Bytes()), out)
-	bufw.Flush()
 
 	// Return success
 	return nil
 }
 
+// Appends data to an existing compressed file, writing the result to out. Every block except for the last one is
+// copied over as-is; only the last block is recompressed together with the new data, and a merged index is written.
+// New blocks use the compression mode of the existing file, and the block size and split mode of c.
+// Metadata of the existing file is kept. Hashes of the existing file are kept and the hashes of c are added; if there
+// are any, the existing data is decompressed (but not recompressed) to compute them.
+// Files whose block data and footer are in a sidecar index have to be appended to with AppendFileWithIndex.
+func (c *Compression) AppendFile(existing io.ReadSeeker, size int64, more io.Reader, out io.Writer) error {
+	var d Decompressor
+	err := d.initFile(c, existing, size, true)
+	if err != nil {
+		return err
+	}
+	return c.appendFile(&d, existing, more, out, nil)
+}
+
+// Same as AppendFile, but for a file whose block data and footer were written to a sidecar index (see
+// CompressOptions.IndexWriter). The compressed blocks are written to out, and the merged index to indexOut.
+func (c *Compression) AppendFileWithIndex(existing io.ReadSeeker, index io.ReadSeeker, indexSize int64, more io.Reader, out io.Writer, indexOut io.Writer) error {
+	var d Decompressor
+	err := d.init(c, existing, index, indexSize, false)
+	if err != nil {
+		return err
+	}
+	return c.appendFile(&d, existing, more, out, &CompressOptions{IndexWriter: indexOut})
+}
+
+// Appends data to the existing file read by d (see AppendFile)
+func (c *Compression) appendFile(d *Decompressor, existing io.ReadSeeker, more io.Reader, out io.Writer, opts *CompressOptions) error {
+	// Compress new blocks with the compression mode of the existing file
+	appendC := *c
+	appendC.CompressionMode = d.c.CompressionMode
+	appendC.BinPath = d.c.BinPath
+
+	// Compute the hashes of c, and every other hash that the existing file has
+	appendC.Hashes = append([]HashType{}, c.Hashes...)
+	var existingHashes []HashType
+	for hashType := range d.hashes {
+		found := false
+		for _, h := range c.Hashes {
+			found = found || h == hashType
+		}
+		if !found {
+			if hashType.newHasher() == nil {
+				return errors.New("Existing file has a hash of a type that doesn't exist, which can't be recomputed")
+			}
+			existingHashes = append(existingHashes, hashType)
+		}
+	}
+	sort.Slice(existingHashes, func(i, j int) bool { return existingHashes[i] < existingHashes[j] })
+	appendC.Hashes = append(appendC.Hashes, existingHashes...)
+	bufw := bufio.NewWriterSize(out, int(appendC.maxCompressedBlockSize()*uint32(appendC.NumThreads)))
+	blockData, err := appendC.newBlockDataBuilder()
+	if err != nil {
+		return err
+	}
+	blockData.index.Metadata = d.metadata
+	if err = appendC.checkBlockDataWritten(blockData, opts); err != nil {
+		return err
+	}
+
+	// Copy over every block except for the last one. Files without blocks (such as empty xz files) have nothing to copy.
+	lastBlock := uint64(0)
+	if d.numBlocks > 0 {
+		lastBlock = d.numBlocks-1
+	}
+	for i := uint64(0); i < lastBlock; i++ {
+		var checksum uint32
+		if d.checksums != nil {
+			checksum = d.checksums[i]
+		}
+		var flags uint8
+		if d.blockFlags != nil {
+			flags = d.blockFlags[i]
+		}
+		blockData.addBlock(uint64(d.blockStarts[i+1]-d.blockStarts[i]), uint64(d.uncompressedStarts[i+1]-d.uncompressedStarts[i]),
+			checksum, d.checksums != nil, flags)
+	}
+	existing.Seek(0, io.SeekStart)
+	codec, _ := getCodec(appendC.CompressionMode)
+	if standalone, ok := codec.(StandaloneCodec); ok {
+		// Standalone codecs may need info about every block, so copy blocks one at a time
+		for i := uint64(0); i < lastBlock; i++ {
+			block := make([]byte, d.blockStarts[i+1]-d.blockStarts[i])
+			if _, err = io.ReadFull(existing, block); err != nil {
+				return err
+			}
+			info, err := standalone.BlockInfo(&appendC, block)
+			if err != nil {
+				return err
+			}
+			blockData.blockInfo = append(blockData.blockInfo, info)
+			if _, err = bufw.Write(block); err != nil {
+				return err
+			}
+		}
+	} else {
+		_, err = io.CopyN(bufw, existing, d.blockStarts[lastBlock])
+		if err != nil {
+			return err
+		}
+	}
+
+	// Hash the data in the blocks we copied over
+	readBuffer := make([]byte, int(appendC.BlockSize)*appendC.NumThreads)
+	if len(blockData.hashers) > 0 {
+		d.Seek(0, io.SeekStart)
+		_, err = io.CopyBuffer(blockData.hashWriter, io.LimitReader(d, d.uncompressedStarts[lastBlock]), readBuffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Decompress the last block, and compress it together with the new data
+	var lastBlockData bytes.Buffer
+	if d.numBlocks > 0 {
+		d.Seek(d.uncompressedStarts[lastBlock], io.SeekStart)
+		_, err = io.CopyBuffer(&lastBlockData, d, readBuffer)
+		if err != nil {
+			return err
+		}
+	}
+	// New blocks are only stored uncompressed if the existing file has stored blocks, so that plain streams stay plain
+	err = appendC.compressBlocks(io.MultiReader(&lastBlockData, more), bufw, blockData, d.blockFlags != nil)
+	if err != nil {
+		return err
+	}
+	return appendC.writeBlockData(blockData, bufw, opts)
+}
+
 /*** BLOCK DECOMPRESSION FUNCTIONS ***/
 // Utility function to decompress a block range using gzip
 func decompressBlockRangeGz(in io.Reader, out io.Writer) (n int, err error) {
@@ -438,21 +894,88 @@ func decompressBlockRangeGz(in io.Reader, out io.Writer) (n int, err error) {
 	return int(written), err
 }
 
-// Utility function to decompress a block using snappy
+// Utility function to decompress a block using snappy. Reads both the snappy framing format and raw snappy blocks
+// (written by older versions).
 func decompressBlockSnappy(in io.Reader, out io.Writer) (n int, err error) {
 	var b bytes.Buffer
 	io.Copy(&b, in)
+	if bytes.HasPrefix(b.Bytes(), snappyStreamMagic) {
+		written, err := io.Copy(out, snappy.NewReader(&b))
+		return int(written), err
+	}
 	decompressed, err := snappy.Decode(nil, b.Bytes())
 	out.Write(decompressed)
 	return len(decompressed), err
 }
 
+// zstd decoder shared by all threads. This is created when first used, and is safe to use from multiple threads.
+var zstdDecoder *zstd.Decoder
+var zstdDecoderLock sync.Mutex
+
+// Gets the zstd decoder
+func getZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecoderLock.Lock()
+	defer zstdDecoderLock.Unlock()
+	if zstdDecoder != nil {
+		return zstdDecoder, nil
+	}
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return nil, err
+	}
+	zstdDecoder = decoder
+	return decoder, nil
+}
+
+// Utility function to decompress a block range using zstd
+func decompressBlockRangeZstd(in io.Reader, out io.Writer) (n int, err error) {
+	decoder, err := getZstdDecoder()
+	if err != nil {
+		return 0, err
+	}
+	var b bytes.Buffer
+	if _, err = io.Copy(&b, in); err != nil {
+		return 0, err
+	}
+	decompressed, err := decoder.DecodeAll(b.Bytes(), nil)
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.Write(decompressed)
+	return len(decompressed), err
+}
+
+// Utility function to decompress a block using brotli. Brotli streams can't be concatenated, so this only takes one block.
+func decompressBlockBrotli(in io.Reader, out io.Writer) (n int, err error) {
+	written, err := io.Copy(out, brotli.NewReader(in))
+	return int(written), err
+}
+
+// Utility function to decompress a block range using bzip2
+func decompressBlockRangeBzip2(in io.Reader, out io.Writer) (n int, err error) {
+	written, err := io.Copy(out, bzip2.NewReader(in))
+	return int(written), err
+}
+
+// Utility function to decompress a block using raw LZMA
+func decompressBlockLzma(in io.Reader, out io.Writer) (n int, err error) {
+	lzmaReader, err := lzma.NewReader(in)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(out, lzmaReader)
+	return int(written), err
+}
+
 // Utility function to decompress a block using LZ4
 func decompressBlockLz4(in io.Reader, out io.Writer, BlockSize int64) (n int, err error) {
 	var b bytes.Buffer
 	io.Copy(&b, in)
-	decompressed, err := lz4.LZ4_decompressFrame(b.Bytes(), BlockSize)
-	out.Write(decompressed)
+	decompressed, err := lz4DecompressFrames(b.Bytes(), BlockSize)
+	if err != nil {
+		return 0, err
+	}
+	_, err = out.Write(decompressed)
 	return len(decompressed), err
 }
 
@@ -494,31 +1017,75 @@ func decompressBlockRangeExecGz(in io.Reader, out io.Writer, binaryPath string,
 	return decompressBlockRangeExecNogz(&b, out, binaryPath, args)
 }
 
+// Utility function to decompress a block range of xz in gzip in pure Go.
+// Falls back to the xz binary (if there is one) for xz files that can't be read in pure Go.
+func decompressBlockRangeXzGz(in io.Reader, out io.Writer, binaryPath string) (n int, err error) {
+	// "Decompress" gzip (this should be in store mode)
+	var b bytes.Buffer
+	_, err = decompressBlockRangeGz(in, &b)
+	if err != nil {
+		return 0, err
+	}
+
+	// Decompress xz
+	var decompressed bytes.Buffer
+	xzReader, err := xz.NewReader(bytes.NewReader(b.Bytes()))
+	if err == nil {
+		_, err = io.Copy(&decompressed, xzReader)
+	}
+	if err != nil {
+		if binaryPath == "" {
+			return 0, err
+		}
+		return decompressBlockRangeExecNogz(&b, out, binaryPath, []string{"-dc"})
+	}
+	n64, err := io.Copy(out, &decompressed)
+	return int(n64), err
+}
+
 // Wrapper function to decompress a block range
 func (d *Decompressor) decompressBlockRange(in io.Reader, out io.Writer) (n int, err error) {
-	switch d.c.CompressionMode { // Select decompression function based off compression mode
-		case GZIP_STORE: fallthrough
-		case GZIP_MIN: fallthrough
-		case GZIP_DEFAULT: fallthrough
-		case GZIP_MAX: return decompressBlockRangeGz(in, out)
-		case XZ_IN_GZ_MIN: return decompressBlockRangeExecGz(in, out, d.c.BinPath, []string{"-dc1"})
-		case XZ_IN_GZ: return decompressBlockRangeExecGz(in, out, d.c.BinPath, []string{"-dc"})
-		case LZ4: if LZ4Cgo {
-				return decompressBlockLz4(in, out, int64(d.c.BlockSize))
-			} else {
-				return decompressBlockRangeExecNogz(in, out, d.c.BinPath, []string{"-dc"})
-			}
-		case SNAPPY: return decompressBlockSnappy(in, out)
+	codec, err := getCodec(d.c.CompressionMode)
+	if err != nil {
+		return 0, err
 	}
-	panic("Compression mode doesn't exist") // If none of the above returned
+	return codec.DecompressBlock(d.c, in, out)
 }
 
 // Wrapper function for decompressBlockRange that implements multithreading
 // Result of decompressing a block
 type DecompressionResult struct {
 	buffer *bytes.Buffer
+	err error
+}
+
+// Error returned when the checksum of a decompressed block doesn't match the one stored in the index
+type ChecksumError struct {
+	Block uint64 // Block number
+	CompressedOffset int64 // Offset of the block in the compressed file
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("Checksum mismatch in block %d at compressed offset %d; file may be corrupted", e.Block, e.CompressedOffset)
+}
+
+// Checks whether a block is stored uncompressed
+func (d *Decompressor) isStored(blockNumber uint64) bool {
+	return d.blockFlags != nil && d.blockFlags[blockNumber]&format.BlockFlagStored != 0
+}
+
+// Checks a decompressed block against the checksum stored in the index, if there is one
+func (d *Decompressor) verifyBlock(block []byte, blockNumber uint64) error {
+	if d.checksums != nil && crc32.Checksum(block, crc32cTable) != d.checksums[blockNumber] {
+		return &ChecksumError{blockNumber, d.blockStarts[blockNumber]}
+	}
+	if d.zstdChecksums != nil && zstdSeekTableChecksum(block) != d.zstdChecksums[blockNumber] {
+		return &ChecksumError{blockNumber, d.blockStarts[blockNumber]}
+	}
+	return nil
 }
-func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Writer, startingBlock uint32) (n int, err error) {
+
+func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Writer, startingBlock uint64) (n int, err error) {
 	// First, use bufio.Reader to reduce the number of reads and bufio.Writer to reduce the number of writes
 	bufin := bufio.NewReader(in)
 	bufout := bufio.NewWriter(out)
@@ -533,10 +1100,10 @@ func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Wr
 
 		for i := 0; i < d.c.NumThreads; i++ {
 			// Get currBlock
-			currBlock := currBatch + uint32(i)
+			currBlock := currBatch + uint64(i)
 
-			// Create channel
-			decompressionResults[i] = make(chan DecompressionResult)
+			// Create channel (buffered, so that threads can finish if we return early)
+			decompressionResults[i] = make(chan DecompressionResult, 1)
 
 			// Check if we've reached EOF
 			if currBlock >= d.numBlocks {
@@ -557,12 +1124,19 @@ func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Wr
 			if DEBUG {
 				log.Printf("Spawning %d", i)
 			}
-			go func(i int, currBlock uint32, in io.Reader) {
+			go func(i int, currBlock uint64, in io.Reader) {
 				var block bytes.Buffer
 				var res DecompressionResult
 
-				// Decompress block
-				d.decompressBlockRange(in, &block)
+				// Decompress (or copy, if the block is stored) and verify block
+				if d.isStored(currBlock) {
+					_, res.err = io.Copy(&block, in)
+				} else {
+					_, res.err = d.decompressBlockRange(in, &block)
+				}
+				if res.err == nil {
+					res.err = d.verifyBlock(block.Bytes(), currBlock)
+				}
 				res.buffer = &block
 				decompressionResults[i] <- res
 				return
@@ -574,14 +1148,18 @@ func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Wr
 
 		// Process results
 		for i := 0; i < d.c.NumThreads; i++ {
-			// If we got EOF, return
+			// If we got EOF, flush and return
 			if eofAt == i {
-				return totalBytesCopied, nil
+				return totalBytesCopied, bufout.Flush()
 			}
 
 			// Get result and close
 			res := <- decompressionResults[i]
 			close(decompressionResults[i])
+			if res.err != nil {
+				bufout.Flush()
+				return totalBytesCopied, res.err
+			}
 
 			// Copy to output and add to total bytes copied
 			n, _ := io.Copy(bufout, res.buffer)
@@ -589,118 +1167,231 @@ func (d *Decompressor) decompressBlockRangeMultithreaded(in io.Reader, out io.Wr
 		}
 
 		// Add NumThreads to currBatch
-		currBatch += uint32(d.c.NumThreads)
+		currBatch += uint64(d.c.NumThreads)
 	}
 }
 
+/*** COMPRESSION MODE DETECTION ***/
+// Error returned when the compression mode of a file can't be determined
+type UnknownFormatError struct {
+	Reason string
+}
+
+func (e *UnknownFormatError) Error() string {
+	return "Unable to determine compression mode of file: " + e.Reason
+}
+
+// Magic bytes at the beginning of blocks
+var gzipMagic = []byte{0x1f, 0x8b}
+var xzMagic = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+var lz4FrameMagic = []byte{0x04, 0x22, 0x4d, 0x18}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+var bzip2Magic = []byte{'B', 'Z', 'h'}
+var snappyStreamMagic = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+
+// Whether blocks of a codec start with magic bytes
+func codecHasMagic(codecID uint8) bool {
+	mode, err := modeFromCodecID(codecID)
+	if err != nil {
+		return false
+	}
+	codec, err := getCodec(mode)
+	return err == nil && codec.Capabilities().MagicBytes
+}
+
+// Detects the codec of a compressed block from its magic bytes. Returns 0 if it can't be detected.
+func detectCodecID(block []byte) uint8 {
+	if bytes.HasPrefix(block, lz4FrameMagic) {
+		return CodecLz4
+	}
+	if bytes.HasPrefix(block, zstdMagic) {
+		return CodecZstd
+	}
+	if bytes.HasPrefix(block, bzip2Magic) {
+		return CodecBzip2
+	}
+	if bytes.HasPrefix(block, snappyStreamMagic) {
+		return CodecSnappy
+	}
+	if bytes.HasPrefix(block, xzMagic) {
+		return CodecXz
+	}
+	if bytes.HasPrefix(block, gzipMagic) {
+		if _, err := bgzfBlockSize(block); err == nil {
+			return CodecBgzf
+		}
+		// Look inside the gzip file to tell xz-in-gzip from plain gzip
+		gzipReader, err := gzip.NewReader(bytes.NewReader(block))
+		if err != nil {
+			return 0
+		}
+		content := make([]byte, len(xzMagic))
+		_, err = io.ReadFull(gzipReader, content)
+		if err == nil && bytes.Equal(content, xzMagic) {
+			return CodecXzInGz
+		}
+		return CodecGzip
+	}
+	// Raw snappy blocks have no magic bytes, so check whether the block decodes
+	if _, err := snappy.Decode(nil, block); err == nil {
+		return CodecSnappy
+	}
+	// Neither do brotli or raw LZMA blocks
+	if _, err := io.Copy(ioutil.Discard, brotli.NewReader(bytes.NewReader(block))); err == nil {
+		return CodecBrotli
+	}
+	if _, err := decompressBlockLzma(bytes.NewReader(block), ioutil.Discard); err == nil {
+		return CodecLzma
+	}
+	return 0
+}
+
+// Detects (or, if the file has a footer, checks) the compression mode and block size from the first block
+func (d *Decompressor) detectCompression(in io.ReadSeeker, hasFooter bool, lastBlockRawSize uint32) error {
+	// Read first block
+	in.Seek(d.blockStarts[0], io.SeekStart)
+	firstBlock := make([]byte, d.blockStarts[1]-d.blockStarts[0])
+	_, err := io.ReadFull(in, firstBlock)
+	if err != nil {
+		return err
+	}
+	codecID := detectCodecID(firstBlock)
+
+	// If we have a footer, it has already set the compression mode and block size. Make sure that the block agrees with it.
+	if hasFooter {
+		if d.isStored(0) {
+			return nil
+		}
+		// Blocks of codecs without magic bytes may happen to look like blocks of another codec, so only check codecs with magic bytes
+		if codecHasMagic(codecID) && codecHasMagic(d.c.getCodecID()) && codecID != d.c.getCodecID() {
+			return &UnknownFormatError{"Codec in footer doesn't match first block"}
+		}
+		return nil
+	}
+
+	// Otherwise, get the compression mode from the detected codec
+	if codecID == 0 {
+		return &UnknownFormatError{"First block has unknown magic bytes"}
+	}
+	mode, err := modeFromCodecID(codecID)
+	if err != nil {
+		return err
+	}
+	preferBinary := d.c.PreferBinary
+	d.c, err = newCompression(mode, lastBlockRawSize, d.c.HeuristicBytes, d.c.NumThreads, d.c.MaxCompressionRatio)
+	if err != nil {
+		return err
+	}
+	d.c.PreferBinary = preferBinary
+
+	// Every block except for the last has the same size, so the size of the first block is the block size
+	if d.numBlocks > 1 {
+		var b bytes.Buffer
+		n, err := d.decompressBlockRange(bytes.NewReader(firstBlock), &b)
+		if err != nil || n == 0 {
+			return &UnknownFormatError{"Unable to decompress first block"}
+		}
+		d.c.BlockSize = uint32(n)
+	}
+	return nil
+}
+
 /*** MAIN DECOMPRESSION INTERFACE ***/
 // ReadSeeker implementation for decompression
 type Decompressor struct {
 	cursorPos *int64		// The current location we have seeked to
 	blockStarts []int64		// The start of each block. These will be recovered from the block sizes
-	numBlocks uint32		// Number of blocks
+	uncompressedStarts []int64	// The start of each block in the uncompressed file. Like blockStarts, this ends with the end of the last block
+	numBlocks uint64		// Number of blocks
+	blockFlags []uint8		// Flags of each block, or nil if no block has any flags
+	checksums []uint32		// CRC-32C of the uncompressed content of each block, or nil if the file doesn't have them
+	zstdChecksums []uint32		// Checksums of each block from a zstd seek table (see zstdSeekTableChecksum), or nil
+	hashes map[HashType][]byte	// Hashes of the whole uncompressed file
+	metadata *Metadata		// Attributes of the original file, or nil if the file doesn't have them
 	decompressedSize int64		// Decompressed size of the file.
 	in io.ReadSeeker		// Input
 	c *Compression			// Compression options
 }
 
-// Decompression constants
-const LengthOffsetFromEnd = GzipDataAndFooterSize+4 // How far the 4-byte length of gzipped data is from the end
-const TrailingBytes = LengthOffsetFromEnd+2+GzipHeaderSize // This is the total size of the last gzip file in the stream, which is not included in the length of gzipped data
+// Loads block data into the decompressor
+func (d *Decompressor) loadIndex(footer *format.Footer, idx *format.Index) {
+	d.numBlocks = uint64(len(idx.BlockSizes))
+	d.blockStarts = make([]int64, d.numBlocks+1) // Starts with 0, ends with end of last block (and beginning of metadata)
+	for i, blockSize := range idx.BlockSizes {
+		d.blockStarts[i+1] = d.blockStarts[i] + int64(blockSize)
+	}
+	if idx.UncompressedSizes != nil {
+		d.uncompressedStarts = make([]int64, d.numBlocks+1)
+		for i, uncompressedSize := range idx.UncompressedSizes {
+			d.uncompressedStarts[i+1] = d.uncompressedStarts[i] + int64(uncompressedSize)
+		}
+	}
+	d.blockFlags = idx.BlockFlags
+	d.checksums = idx.Checksums
+	d.hashes = make(map[HashType][]byte)
+	for _, hash := range idx.Hashes {
+		d.hashes[HashType(hash.Type)] = hash.Digest
+	}
+	d.metadata = idx.Metadata
+	d.decompressedSize = int64(footer.DecompressedSize)
+}
 
 // Initializes decompressor. Takes 3 reads. Works best with cached ReadSeeker.
-func (d* Decompressor) init(c *Compression, in io.ReadSeeker, size int64) error {
+// Block data and footer are read from the end of index, which is either the compressed file itself or a sidecar index.
+// If detect is set, the compression mode is checked against (or, for files without a footer, detected from) the first block.
+func (d* Decompressor) init(c *Compression, in io.ReadSeeker, index io.ReadSeeker, indexSize int64, detect bool) error {
 	// Copy over compression
 	d.c = c
 
 	// Initialize cursor position
 	d.cursorPos = new(int64)
 
-	// Read length of gzipped block data in gzip extra data fields
-	in.Seek(size-LengthOffsetFromEnd, io.SeekStart)
-	gzippedBlockDataLenBytes := make([]byte, 4)
-	_, err := in.Read(gzippedBlockDataLenBytes)
+	// Read footer and block data
+	footer, idx, err := format.ReadTrailer(index, indexSize)
 	if err != nil {
 		return err
 	}
-	gzippedBlockDataLen := bytesToUint32(gzippedBlockDataLenBytes)
 
-	// Get gzipped block data in gzip extra data fields
-	if DEBUG {
-		log.Printf("size = %d, gzippedBlockDataLen = %d\n", size, gzippedBlockDataLen)
-	}
-	in.Seek(size-TrailingBytes-int64(gzippedBlockDataLen), io.SeekStart)
-	gzippedBlockData := make([]byte, gzippedBlockDataLen)
-	in.Read(gzippedBlockData)
-
-	// Get raw gzipped block data
-	gzippedBlockDataRaw := make([]byte, 0)
-	gzipHeaderDummy := make([]byte, GzipHeaderSize)
-	gzipExtraDataLenBytes := make([]byte, 2)
-	gzipDataAndFooterDummy := make([]byte, GzipDataAndFooterSize)
-	gzippedBlockDataRawReader := bytes.NewReader(gzippedBlockData)
-	for {
-		// This read and possibly the last read are the only ones which can EOF
-		_, err := gzippedBlockDataRawReader.Read(gzipHeaderDummy)
-		if err == io.EOF {
-			break
-		}
-		// Note: These reads should never EOF
-		gzippedBlockDataRawReader.Read(gzipExtraDataLenBytes)
-		gzipExtraDataLen := bytesToUint16(gzipExtraDataLenBytes)
-		if DEBUG {
-			log.Printf("%d", gzipExtraDataLen)
+	// If the file describes itself, recreate compression options from the footer so that they match the file.
+	// Otherwise, this is an older file without a footer; we have to trust the compression options we were given.
+	if footer.Version != 0 {
+		mode, err := modeFromCodecID(footer.CodecID)
+		if err != nil {
+			return err
 		}
-		gzipExtraData := make([]byte, gzipExtraDataLen)
-		gzippedBlockDataRawReader.Read(gzipExtraData)
-		gzippedBlockDataRaw = append(gzippedBlockDataRaw, gzipExtraData...)
-		// Read the footer. This may EOF
-		_, err = gzippedBlockDataRawReader.Read(gzipDataAndFooterDummy)
-		if err == io.EOF {
-			break
+		d.c, err = newCompression(mode, footer.BlockSize, c.HeuristicBytes, c.NumThreads, c.MaxCompressionRatio)
+		if err != nil {
+			return err
 		}
+		d.c.PreferBinary = c.PreferBinary
 	}
+	d.loadIndex(footer, idx)
 
-	// Decompress gzipped block data
-	blockDataReader, err := gzip.NewReader(bytes.NewReader(gzippedBlockDataRaw))
-	if err != nil {
-		return err
-	}
-	blockData, err := ioutil.ReadAll(blockDataReader)
-	if err != nil {
-		return err
+	// Detect or check compression mode from the first block if requested
+	if detect {
+		err = d.detectCompression(in, footer.Version != 0, uint32(idx.LastBlockSize))
+		if err != nil {
+			return err
+		}
 	}
 
-	// Parse the block data
-	blockDataLen := len(blockData)
-	if blockDataLen%4 != 0 {
-		return errors.New("Length of block data should be a multiple of 4; file may be corrupted")
-	}
-	d.numBlocks = uint32((blockDataLen-4)/4)
-	if DEBUG {
-		log.Printf("metadata len, numblocks = %d, %d", blockDataLen, d.numBlocks)
+	// Derive uncompressed size of file (version 2+ files store it in the footer)
+	if footer.Version < 2 {
+		d.decompressedSize = int64(d.numBlocks-1) * int64(d.c.BlockSize) + int64(idx.LastBlockSize)
 	}
-	d.blockStarts = make([]int64, d.numBlocks+1) // Starts with 0, ends with end of last block (and beginning of metadata)
-	currentBlockPosition := int64(0)
-	for i := uint32(0); i < d.numBlocks; i++ { // Loop through block data, getting starts of blocks.
-		bs := i*4 // Location of start of data for our current block
-		d.blockStarts[i] = currentBlockPosition // Note: Remember that the first entry can be anything now, but we're making the first
-							// of this array still always 0 for easier indexing
-		currentBlockSize := bytesToUint32(blockData[bs:bs+4])
-		currentBlockPosition += int64(currentBlockSize) // Note: We increase the current block position after
-							// recording the size (the size is for the current block this time, though)
-	}
-	d.blockStarts[d.numBlocks] = currentBlockPosition // End of last block (and beginning of metadata)
-
-	//log.Printf("Block Starts: %v\n", d.blockStarts)
-
-	// Get uncompressed size of last block and derive uncompressed size of file
-	lastBlockRawSize := bytesToUint32(blockData[blockDataLen-4:])
-	d.decompressedSize = int64(d.numBlocks-1) * int64(d.c.BlockSize) + int64(lastBlockRawSize)
 	if DEBUG {
 		log.Printf("Decompressed size = %d", d.decompressedSize)
 	}
 
+	// If the file has fixed-size blocks, derive their uncompressed starts from the block size
+	if d.uncompressedStarts == nil {
+		d.uncompressedStarts = make([]int64, d.numBlocks+1)
+		for i := uint64(1); i < d.numBlocks; i++ {
+			d.uncompressedStarts[i] = int64(i) * int64(d.c.BlockSize)
+		}
+		d.uncompressedStarts[d.numBlocks] = d.decompressedSize
+	}
+
 	// Initialize cursor position and copy over reader
 	*d.cursorPos = 0
 	in.Seek(0, io.SeekStart)
@@ -709,6 +1400,27 @@ func (d* Decompressor) init(c *Compression, in io.ReadSeeker, size int64) error
 	return nil
 }
 
+// Initializes decompressor for a file that has its block data and footer at the end, or for a BGZF or seekable zstd file
+// without them. BGZF files end with the BGZF end-of-file marker and seekable zstd files end with the seekable magic number,
+// neither of which ever ends other files. Files without an end-of-file marker are only treated as BGZF files if they
+// don't have block data.
+func (d *Decompressor) initFile(c *Compression, in io.ReadSeeker, size int64, detect bool) error {
+	if hasBgzfEOF(in, size) {
+		return d.initBgzf(c, in, size, nil)
+	}
+	if hasZstdSeekTable(in, size) {
+		return d.initZstdSeekable(c, in, size)
+	}
+	if hasXzFooter(in, size) {
+		return d.initXz(c, in, size)
+	}
+	err := d.init(c, in, in, size, detect)
+	if err != nil && startsWithBgzfBlock(in) {
+		return d.initBgzf(c, in, size, nil)
+	}
+	return err
+}
+
 // Reads data using a decompressor
 func (d Decompressor) Read(p []byte) (int, error) {
 	if DEBUG {
@@ -722,17 +1434,23 @@ func (d Decompressor) Read(p []byte) (int, error) {
 		return 0, io.EOF
 	}
 
+	// Nothing to read
+	bytesToRead := len(p) // Number of bytes to read
+	if bytesToRead == 0 {
+		return 0, nil
+	}
+
 	// Get block range to read
-	blockNumber := *d.cursorPos / int64(d.c.BlockSize)
+	blockNumber := d.findBlock(*d.cursorPos)
 	blockStart := d.blockStarts[blockNumber] // Start position of blocks to read
-	dataOffset := *d.cursorPos % int64(d.c.BlockSize) // Offset of data to read in blocks to read
-	bytesToRead := len(p) // Number of bytes to read
-	blocksToRead := (int64(bytesToRead) + dataOffset) / int64(d.c.BlockSize) + 1 // Number of blocks to read
+	dataOffset := *d.cursorPos - d.uncompressedStarts[blockNumber] // Offset of data to read in blocks to read
 	returnEOF := false
-	if blockNumber + blocksToRead > int64(d.numBlocks) { // Overflowed the last block
-		blocksToRead = int64(d.numBlocks)-blockNumber
+	readEnd := *d.cursorPos + int64(bytesToRead) // Position after the last byte to read
+	if readEnd >= d.decompressedSize { // Reading up to (or past) the end of the file
+		readEnd = d.decompressedSize
 		returnEOF = true
 	}
+	blocksToRead := d.findBlock(readEnd-1) - blockNumber + 1 // Number of blocks to read
 	var blockEnd int64 // End position of blocks to read
 	blockEnd = d.blockStarts[blockNumber + blocksToRead] // Start of the block after the last block we want to get is the end of the last block we want to get
 	blockLen := blockEnd - blockStart
@@ -753,10 +1471,10 @@ func (d Decompressor) Read(p []byte) (int, error) {
 
 	// Decompress block range
 	var b bytes.Buffer
-	n, err := d.decompressBlockRangeMultithreaded(&compressedBlocks, &b, uint32(blockNumber))
+	n, err := d.decompressBlockRangeMultithreaded(&compressedBlocks, &b, uint64(blockNumber))
 	if err != nil {
 		log.Println("Decompression error")
-		return n, err
+		return 0, err
 	}
 
 	// Calculate bytes read
@@ -791,6 +1509,13 @@ func (d Decompressor) Read(p []byte) (int, error) {
 	return int(bytesRead), nil
 }
 
+// Finds the block containing an uncompressed position using a binary search over the uncompressed starts of blocks
+func (d Decompressor) findBlock(pos int64) int64 {
+	return int64(sort.Search(int(d.numBlocks), func(i int) bool {
+		return d.uncompressedStarts[i+1] > pos
+	}))
+}
+
 // Seeks to a location in compressed stream
 func (d Decompressor) Seek(offset int64, whence int) (int64, error) {
 	// Seek to offset in cursorPos
@@ -806,9 +1531,47 @@ func (d Decompressor) Seek(offset int64, whence int) (int64, error) {
 	return offset, nil
 }
 
+// Gets a hash of the whole uncompressed file as a lowercase hex string, without decompressing anything.
+// Returns ErrHashNotStored if the file was compressed without this hash.
+func (d Decompressor) Hash(kind HashType) (string, error) {
+	digest, ok := d.hashes[kind]
+	if !ok {
+		return "", ErrHashNotStored
+	}
+	return hex.EncodeToString(digest), nil
+}
+
 // Decompresses a file. Argument "size" is very useful here.
+// Files with a footer are decompressed using the compression mode and block size stored in them. The compression
+// mode and block size of c are only used for older files without a footer.
 func (c *Compression) DecompressFile(in io.ReadSeeker, size int64) (FileHandle io.ReadSeeker, decompressedSize int64, err error) {
 	var decompressor Decompressor
-	err = decompressor.init(c, in, size)
+	err = decompressor.initFile(c, in, size, false)
+	return decompressor, decompressor.decompressedSize, err
+}
+
+// Decompresses a file whose block data and footer were written to a sidecar index (see CompressOptions.IndexWriter).
+// The size of the compressed file isn't needed, but the size of the index is.
+func (c *Compression) DecompressFileWithIndex(in io.ReadSeeker, index io.ReadSeeker, indexSize int64) (FileHandle io.ReadSeeker, decompressedSize int64, err error) {
+	var decompressor Decompressor
+	err = decompressor.init(c, in, index, indexSize, false)
 	return decompressor, decompressor.decompressedSize, err
 }
+
+// Opens a compressed file without knowing how it was compressed. The compression mode is taken from the footer if
+// there is one, and detected from the magic bytes of the first block otherwise. BGZF files without block data (such as
+// ones written by bgzip) are opened by reading the header of every block, seekable zstd files by reading their seek
+// table, and xz files by reading their index. Returns an *UnknownFormatError if
+// the compression mode can't be determined.
+func Open(in io.ReadSeeker, size int64) (*Decompressor, error) {
+	c, err := NewCompressionAdvanced(GZIP_DEFAULT, 0, 1048576, 12, 0.9)
+	if err != nil {
+		return nil, err
+	}
+	decompressor := new(Decompressor)
+	err = decompressor.initFile(c, in, size, true)
+	if err != nil {
+		return nil, err
+	}
+	return decompressor, nil
+}
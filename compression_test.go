@@ -2,9 +2,20 @@ package press
 
 import (
 	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/id01/rclone-compression/format"
 //	"time"
 )
 
@@ -125,4 +136,657 @@ func TestFileCompressionInfo(t *testing.T) {
 	_, extension, err = comp.GetFileCompressionInfo(inFile2)
 	t.Logf("Extension for compressed: %s\n", extension)
 	inFile.Close()
-}
\ No newline at end of file
+}
+
+// Generates some compressible test data
+func makeTestData(size int) []byte {
+	words := []string{"press ", "rclone ", "compression ", "block ", "index ", "footer ", "gzip ", "\n"}
+	random := rand.New(rand.NewSource(int64(size)))
+	var data bytes.Buffer
+	for data.Len() < size {
+		data.WriteString(words[random.Intn(len(words))])
+	}
+	return data.Bytes()[:size]
+}
+
+func TestDecompressWithFooter(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(1000000)
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decompress using a compression object with a different mode and block size
+	comp2, err := NewCompressionPreset("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	FileHandle, decompressedSize, err := comp2.DecompressFile(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressedSize != int64(len(data)) {
+		t.Fatalf("Decompressed size is %d, expected %d", decompressedSize, len(data))
+	}
+	decompressed, err := ioutil.ReadAll(FileHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Decompressed data doesn't match original data")
+	}
+}
+
+// Compresses test data using a preset
+func compressTestData(t *testing.T, preset string, data []byte) []byte {
+	comp, err := NewCompressionPreset(preset)
+	if err == ErrBinaryNotFound {
+		t.Skipf("%s: %v", preset, err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed.Bytes()
+}
+
+// Rewrites the block data and footer of a compressed file in an older version of the file format
+// (version 0 meaning the trailer used before footers existed)
+func downgradeFormat(t *testing.T, compressed []byte, version uint8) []byte {
+	footer, idx, err := format.ReadTrailer(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocksLen := uint64(0)
+	for _, blockSize := range idx.BlockSizes {
+		blocksLen += blockSize
+	}
+
+	// Rewrite trailer with 32-bit block data
+	old := bytes.NewBuffer(append([]byte{}, compressed[:blocksLen]...))
+	idx.LastBlockSize = footer.DecompressedSize - (footer.NumBlocks-1)*uint64(footer.BlockSize)
+	footer.Version = version
+	err = format.WriteTrailer(old, idx, footer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return old.Bytes()
+}
+
+func TestOpen(t *testing.T) {
+	data := makeTestData(1000000)
+	presets := []string{"gzip-min", "xz-min", "lz4", "snappy", "zstd-fast", "zstd-default", "zstd-max", "brotli-fast", "brotli-default", "lzma"}
+	if _, err := exec.LookPath(Bzip2Command); err == nil {
+		presets = append(presets, "bzip2-min") // Compressing bzip2 needs the binary
+	}
+	for _, preset := range presets {
+		for _, version := range []uint8{format.FooterVersion, 1, 0} {
+			compressed := compressTestData(t, preset, data)
+			if version != format.FooterVersion {
+				compressed = downgradeFormat(t, compressed, version)
+			}
+			FileHandle, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+			if err != nil {
+				t.Fatalf("%s (version %d): %v", preset, version, err)
+			}
+			decompressed, err := ioutil.ReadAll(FileHandle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Fatalf("%s (version %d): Decompressed data doesn't match original data", preset, version)
+			}
+		}
+	}
+
+	// Corrupt the first block of a file without a footer so that its mode can't be detected
+	compressed := downgradeFormat(t, compressTestData(t, "snappy", data), 0)
+	copy(compressed, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	_, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if _, ok := err.(*UnknownFormatError); !ok {
+		t.Fatalf("Expected UnknownFormatError, got %v", err)
+	}
+}
+
+func TestXzWithoutBinary(t *testing.T) {
+	data := makeTestData(1000000)
+	var compressed []byte
+	t.Run("NoBinary", func(t *testing.T) {
+		// Compress and decompress without xz on the path
+		t.Setenv("PATH", "")
+		compressed = compressTestData(t, "xz-default", data)
+		FileHandle, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := ioutil.ReadAll(FileHandle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatal("Decompressed data doesn't match original data")
+		}
+	})
+
+	// Files compressed in pure Go should be readable with the binary
+	comp, err := NewCompressionPreset("xz-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp.BinPath == "" {
+		t.Skip("xz binary not found")
+	}
+	comp.PreferBinary = true
+	FileHandle, _, err := comp.DecompressFile(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(FileHandle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Data decompressed with the xz binary doesn't match original data")
+	}
+}
+
+func TestBzip2NeedsBinary(t *testing.T) {
+	// Creating a Compression that can't compress because its binary is missing should fail early
+	t.Setenv("PATH", "")
+	if _, err := NewCompressionPreset("bzip2"); err != ErrBinaryNotFound {
+		t.Fatalf("Expected ErrBinaryNotFound, got %v", err)
+	}
+	comp, err := NewCompressionPreset("lzma")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// But a bzip2 Compression with its binary gone should still fail cleanly when compressing
+	comp.CompressionMode = BZIP2
+	var compressed bytes.Buffer
+	data := makeTestData(100000)
+	if err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed); err == nil {
+		t.Fatal("Compressing bzip2 without the binary should fail")
+	}
+}
+
+func TestBzip2AndLzma(t *testing.T) {
+	data := makeTestData(1000000)
+	compressedBzip2 := compressTestData(t, "bzip2", data) // Skips the test if the bzip2 binary isn't found
+	compressedLzma := compressTestData(t, "lzma", data)
+
+	// Neither should need a binary to decompress
+	t.Run("NoBinary", func(t *testing.T) {
+		t.Setenv("PATH", "")
+		for _, compressed := range [][]byte{compressedBzip2, compressedLzma} {
+			FileHandle, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRandomAccess(t, FileHandle, data)
+		}
+	})
+
+	// Raw LZMA blocks should be readable as .lzma files by the xz binary
+	binPath, err := exec.LookPath(XZCommand)
+	if err != nil {
+		t.Skip("xz binary not found")
+	}
+	d, err := Open(bytes.NewReader(compressedLzma), int64(len(compressedLzma)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(binPath, "--format=lzma", "-dc")
+	cmd.Stdin = bytes.NewReader(compressedLzma[d.blockStarts[0]:d.blockStarts[1]])
+	decompressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data[:d.uncompressedStarts[1]]) {
+		t.Fatal("Block decompressed by the xz binary doesn't match original data")
+	}
+}
+
+func TestSnappyFraming(t *testing.T) {
+	comp, err := NewCompressionPreset("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(1000000)
+	var compressed, index bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{IndexWriter: &index})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the index in it, the compressed file should be a standard snappy stream
+	decompressed, err := ioutil.ReadAll(snappy.NewReader(bytes.NewReader(compressed.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Compressed file without index isn't a snappy stream of the original data")
+	}
+
+	// Corruption should be caught by the chunk checksums
+	var block bytes.Buffer
+	if _, _, err = comp.compressBlockSnappy(data[:100000], &block); err != nil {
+		t.Fatal(err)
+	}
+	block.Bytes()[block.Len()/2] ^= 0xff
+	if _, err = decompressBlockSnappy(&block, ioutil.Discard); err == nil {
+		t.Fatal("Corrupted snappy block wasn't rejected")
+	}
+
+	// Raw snappy blocks from older versions should still decompress
+	var b bytes.Buffer
+	if _, err = decompressBlockSnappy(bytes.NewReader(snappy.Encode(nil, data[:100000])), &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), data[:100000]) {
+		t.Fatal("Decompressed raw snappy block doesn't match original data")
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	// Use incompressible data so that blocks are stored uncompressed, which can't detect corruption by themselves
+	data := make([]byte, 1000000)
+	rand.New(rand.NewSource(1)).Read(data)
+	comp, err := NewCompressionPreset("snappy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &b, &CompressOptions{StoreIncompressibleBlocks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := b.Bytes()
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockStart := d.blockStarts[1]
+	compressed[blockStart+100] ^= 0xff
+
+	d, err = Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(d)
+	checksumErr, ok := err.(*ChecksumError)
+	if !ok {
+		t.Fatalf("Expected ChecksumError, got %v", err)
+	}
+	if checksumErr.Block != 1 || checksumErr.CompressedOffset != blockStart {
+		t.Fatalf("Checksum error is for block %d at %d, expected block 1 at %d", checksumErr.Block, checksumErr.CompressedOffset, blockStart)
+	}
+}
+
+func TestHash(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp.Hashes = []HashType{HashMD5, HashSHA256}
+	data := makeTestData(1000000)
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	expected := map[HashType]string{HashMD5: hex.EncodeToString(md5Sum[:]), HashSHA256: hex.EncodeToString(sha256Sum[:])}
+	for kind, expectedHash := range expected {
+		hash, err := d.Hash(kind)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hash != expectedHash {
+			t.Fatalf("Hash %d is %s, expected %s", kind, hash, expectedHash)
+		}
+	}
+	if _, err := d.Hash(HashSHA1); err != ErrHashNotStored {
+		t.Fatalf("Expected ErrHashNotStored, got %v", err)
+	}
+}
+
+// Reads random ranges from a decompressor and compares them with the original data
+func checkRandomAccess(t *testing.T, d io.ReadSeeker, data []byte) {
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		start := random.Intn(len(data))
+		length := random.Intn(300000)+1
+		if start+length > len(data) {
+			length = len(data)-start
+		}
+		d.Seek(int64(start), io.SeekStart)
+		b := make([]byte, length)
+		_, err := io.ReadFull(d, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data[start:start+length]) {
+			t.Fatalf("Data read at %d (length %d) doesn't match original data", start, length)
+		}
+	}
+}
+
+func TestRandomAccess(t *testing.T) {
+	data := makeTestData(1000000)
+	compressed := compressTestData(t, "gzip-min", data)
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+}
+
+func TestStoredBlocks(t *testing.T) {
+	// Alternate between compressible and incompressible regions
+	data := makeTestData(2000000)
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < len(data); i += 524288 {
+		random.Read(data[i:i+262144])
+	}
+	comp, err := NewCompressionPreset("gzip-default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{StoreIncompressibleBlocks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.blockFlags == nil || !d.isStored(0) || d.isStored(2) {
+		t.Fatal("Incompressible blocks weren't stored")
+	}
+	checkRandomAccess(t, d, data)
+
+	// Without the option, incompressible blocks should stay gzip
+	plain := compressTestData(t, "gzip-default", data)
+	d, err = Open(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.blockFlags != nil {
+		t.Fatal("Blocks were stored without StoreIncompressibleBlocks")
+	}
+	checkRandomAccess(t, d, data)
+}
+
+func TestGzipStoreIsGzip(t *testing.T) {
+	// gzip-store never compresses below MaxCompressionRatio, but should still write gzip files
+	data := makeTestData(500000)
+	compressed := compressTestData(t, "gzip-store", data)
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("gzip-store file doesn't decompress with compress/gzip")
+	}
+}
+
+func TestSidecarIndex(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(1000000)
+	var compressed, index bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{IndexWriter: &index})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the index in it, the compressed file should be a plain gzip stream
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Compressed file without index isn't a plain gzip stream of the original data")
+	}
+
+	// Decompress using the index
+	FileHandle, decompressedSize, err := comp.DecompressFileWithIndex(bytes.NewReader(compressed.Bytes()), bytes.NewReader(index.Bytes()), int64(index.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decompressedSize != int64(len(data)) {
+		t.Fatalf("Decompressed size is %d, expected %d", decompressedSize, len(data))
+	}
+	checkRandomAccess(t, FileHandle, data)
+}
+
+func TestAppendFile(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp.Hashes = []HashType{HashMD5}
+	data := makeTestData(1000000)
+	var compressed bytes.Buffer
+	err = comp.CompressFile(bytes.NewReader(data[:600000]), 600000, &compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Append the rest of the data, adding another hash
+	appendComp := *comp
+	appendComp.Hashes = []HashType{HashSHA256}
+	var appended bytes.Buffer
+	err = appendComp.AppendFile(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), bytes.NewReader(data[600000:]), &appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d2, err := Open(bytes.NewReader(appended.Bytes()), int64(appended.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every block except for the last should have been copied over as-is
+	lastBlock := d.numBlocks-1
+	if !bytes.Equal(appended.Bytes()[:d.blockStarts[lastBlock]], compressed.Bytes()[:d.blockStarts[lastBlock]]) {
+		t.Fatal("Full blocks weren't copied over as-is")
+	}
+	checkRandomAccess(t, d2, data)
+	md5Sum := md5.Sum(data)
+	hash, err := d2.Hash(HashMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hex.EncodeToString(md5Sum[:]) {
+		t.Fatal("Hash of appended file doesn't match data")
+	}
+	sha256Sum := sha256.Sum256(data)
+	hash, err = d2.Hash(HashSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != hex.EncodeToString(sha256Sum[:]) {
+		t.Fatal("Added hash of appended file doesn't match data")
+	}
+}
+
+func TestAppendFileWithIndex(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(1000000)
+	var compressed, index bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data[:600000]), 600000, &compressed, &CompressOptions{IndexWriter: &index})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Appending should write blocks and index separately again
+	var appended, appendedIndex bytes.Buffer
+	err = comp.AppendFileWithIndex(bytes.NewReader(compressed.Bytes()), bytes.NewReader(index.Bytes()), int64(index.Len()),
+		bytes.NewReader(data[600000:]), &appended, &appendedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gzipReader, err := gzip.NewReader(bytes.NewReader(appended.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Appended file without its index isn't a plain gzip stream of the data")
+	}
+	FileHandle, _, err := comp.DecompressFileWithIndex(bytes.NewReader(appended.Bytes()), bytes.NewReader(appendedIndex.Bytes()), int64(appendedIndex.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, FileHandle, data)
+}
+
+// A mode whose compressed files are files of another container format, such as BGZF, that other tools can read
+type containerModeTest struct {
+	preset string
+	blockSize uint32 // Block size to use instead of the preset's, if not 0
+	mode int
+	checkFile func(t *testing.T, compressed []byte, data []byte) // Checks that a file is a file of the container format with the data
+}
+
+// Opens a file of a container mode, and checks that it opens as that mode with the data
+func checkContainerOpen(t *testing.T, test containerModeTest, compressed []byte, data []byte) {
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.c.CompressionMode != test.mode {
+		t.Fatalf("Opened as mode %d", d.c.CompressionMode)
+	}
+	checkRandomAccess(t, d, data)
+}
+
+// Appends to a file of a container mode, and checks that it is still a file of the container format
+func checkContainerAppend(t *testing.T, test containerModeTest, compressed []byte, data []byte) {
+	comp, err := NewCompressionPreset(test.preset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var appended bytes.Buffer
+	err = comp.AppendFile(bytes.NewReader(compressed), int64(len(compressed)), bytes.NewReader(data[:100000]), &appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendedData := append(append([]byte{}, data...), data[:100000]...)
+	test.checkFile(t, appended.Bytes(), appendedData)
+	checkContainerOpen(t, test, appended.Bytes(), appendedData)
+}
+
+func TestContainerModes(t *testing.T) {
+	data := makeTestData(1000000)
+	for _, test := range []containerModeTest{bgzfModeTest, zstdSeekableModeTest, xzModeTest} {
+		t.Run(test.preset, func(t *testing.T) {
+			comp, err := NewCompressionPreset(test.preset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.blockSize != 0 {
+				comp.BlockSize = test.blockSize
+			}
+			var compressed, index bytes.Buffer
+			err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{IndexWriter: &index})
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.checkFile(t, compressed.Bytes(), data)
+
+			// It should open with its own index, and with the sidecar index
+			checkContainerOpen(t, test, compressed.Bytes(), data)
+			FileHandle, _, err := comp.DecompressFileWithIndex(bytes.NewReader(compressed.Bytes()), bytes.NewReader(index.Bytes()), int64(index.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRandomAccess(t, FileHandle, data)
+
+			// Appending should keep it a file of the container format, with or without the sidecar index
+			checkContainerAppend(t, test, compressed.Bytes(), data)
+			var appended, appendedIndex bytes.Buffer
+			err = comp.AppendFileWithIndex(bytes.NewReader(compressed.Bytes()), bytes.NewReader(index.Bytes()), int64(index.Len()),
+				bytes.NewReader(data[:100000]), &appended, &appendedIndex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			appendedData := append(append([]byte{}, data...), data[:100000]...)
+			test.checkFile(t, appended.Bytes(), appendedData)
+			checkContainerOpen(t, test, appended.Bytes(), appendedData)
+			FileHandle, _, err = comp.DecompressFileWithIndex(bytes.NewReader(appended.Bytes()), bytes.NewReader(appendedIndex.Bytes()), int64(appendedIndex.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if FileHandle.(Decompressor).c.CompressionMode != test.mode {
+				t.Fatalf("Opened with the appended sidecar index as mode %d", FileHandle.(Decompressor).c.CompressionMode)
+			}
+			checkRandomAccess(t, FileHandle, appendedData)
+
+			// Hashes and metadata can only be stored in the sidecar index
+			hashComp := *comp
+			hashComp.Hashes = []HashType{HashSHA256}
+			if err = hashComp.CompressFile(bytes.NewReader(data), int64(len(data)), ioutil.Discard); err != ErrIndexWriterNeeded {
+				t.Fatalf("Expected ErrIndexWriterNeeded for hashes, got %v", err)
+			}
+			err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), ioutil.Discard, &CompressOptions{Metadata: &Metadata{Name: "test"}})
+			if err != ErrIndexWriterNeeded {
+				t.Fatalf("Expected ErrIndexWriterNeeded for metadata, got %v", err)
+			}
+			err = hashComp.AppendFile(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), bytes.NewReader(data[:100000]), ioutil.Discard)
+			if err != ErrIndexWriterNeeded {
+				t.Fatalf("Expected ErrIndexWriterNeeded for hashes when appending, got %v", err)
+			}
+			compressed.Reset()
+			index.Reset()
+			err = hashComp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{IndexWriter: &index})
+			if err != nil {
+				t.Fatal(err)
+			}
+			FileHandle, _, err = comp.DecompressFileWithIndex(bytes.NewReader(compressed.Bytes()), bytes.NewReader(index.Bytes()), int64(index.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = FileHandle.(Decompressor).Hash(HashSHA256); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,565 @@
+package press
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"sort"
+)
+
+/*** OPTIMAL DEFLATE ***/
+// An exhaustive deflate encoder for GZIP_MAX, in the spirit of zopfli. See RFC 1951 and RFC 1952.
+// Every match at every position is found up front, then the cheapest way to parse the block is found with dynamic programming.
+// The cost of each symbol is taken from the Huffman code of the previous parse, and the parse is repeated a number of times,
+// keeping the smallest result. Output is a standard gzip member, which compress/gzip (and the gzip binary) can decode.
+const deflateMinMatch = 3
+const deflateMaxMatch = 258
+const deflateWindowSize = 32768
+const deflateHashLog = 15
+const deflateMaxChain = 8192 // Maximum number of earlier positions searched for matches at each position
+const deflateIterations = 15 // Number of times the block is parsed with updated symbol costs
+const deflateMaxStoredBlock = 65535
+const deflateEndOfBlock = 256
+
+// Huffman code length limits
+const deflateMaxCodeBits = 15
+const deflateMaxCodeLengthBits = 7
+
+// Base lengths and extra bits of length symbols 257-285
+var deflateLengthBase = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+var deflateLengthExtra = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+
+// Base distances and extra bits of distance symbols 0-29
+var deflateDistBase = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+var deflateDistExtra = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+
+// Order in which code length code lengths are written in a dynamic block header
+var deflateCodeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+// Symbol (0-28, add 257 for the lit/len symbol) of each match length, and symbol of each distance
+var deflateLengthSymbols = func() (symbols [deflateMaxMatch + 1]uint8) {
+	for sym := len(deflateLengthBase) - 1; sym >= 0; sym-- {
+		for length := int(deflateLengthBase[sym]); length <= deflateMaxMatch && symbols[length] == 0 && length >= deflateMinMatch; length++ {
+			symbols[length] = uint8(sym)
+		}
+	}
+	return symbols
+}()
+var deflateDistSymbols = func() (symbols [deflateWindowSize + 1]uint8) {
+	sym := 0
+	for dist := 1; dist <= deflateWindowSize; dist++ {
+		if sym+1 < len(deflateDistBase) && dist >= int(deflateDistBase[sym+1]) {
+			sym++
+		}
+		symbols[dist] = uint8(sym)
+	}
+	return symbols
+}()
+
+// A literal (dist 0) or a match
+type deflateSymbol struct {
+	length uint16 // Byte value for literals
+	dist uint16
+}
+
+/*** MATCH FINDING ***/
+// Finds all useful matches at every position of in. For each position, matches are stored as a list of increasing lengths,
+// each with the smallest distance at which it (and every length above the previous one in the list) can be found.
+// Matches at position i are matches[starts[i]:starts[i+1]], each packed as length<<16 | distance.
+func deflateFindMatches(in []byte) (matches []uint32, starts []int32) {
+	const hashMask = 1<<deflateHashLog - 1
+	head := make([]int32, 1<<deflateHashLog)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(in))
+	starts = make([]int32, len(in)+1)
+	hash := func(i int) int {
+		return int((uint32(in[i])<<16|uint32(in[i+1])<<8|uint32(in[i+2]))*2654435761>>(32-deflateHashLog)) & hashMask
+	}
+	for i := 0; i < len(in); i++ {
+		starts[i] = int32(len(matches))
+		if i+deflateMinMatch > len(in) {
+			continue
+		}
+		h := hash(i)
+		maxLen := len(in) - i
+		if maxLen > deflateMaxMatch {
+			maxLen = deflateMaxMatch
+		}
+		best := deflateMinMatch - 1
+		for j, chain := head[h], 0; j >= 0 && i-int(j) <= deflateWindowSize && chain < deflateMaxChain; j, chain = prev[j], chain+1 {
+			// Check the byte that would make this match longer than the best one first
+			if in[int(j)+best] != in[i+best] {
+				continue
+			}
+			length := 0
+			for length < maxLen && in[int(j)+length] == in[i+length] {
+				length++
+			}
+			if length > best {
+				best = length
+				matches = append(matches, uint32(length)<<16|uint32(i-int(j)))
+				if length == maxLen {
+					break
+				}
+			}
+		}
+		prev[i] = head[h]
+		head[h] = int32(i)
+	}
+	starts[len(in)] = int32(len(matches))
+	return matches, starts
+}
+
+/*** PARSING ***/
+// Cost in bits of each lit/len symbol and distance symbol
+type deflateCosts struct {
+	litLen [286]float32
+	dist [30]float32
+}
+
+// Costs of the fixed Huffman code, used for the first parse
+func deflateFixedCosts() *deflateCosts {
+	costs := &deflateCosts{}
+	lengths := deflateFixedLitLenLengths()
+	for sym := range costs.litLen {
+		costs.litLen[sym] = float32(lengths[sym])
+	}
+	for sym := range costs.dist {
+		costs.dist[sym] = 5
+	}
+	return costs
+}
+
+// Costs of symbols from their frequencies in a parse (their entropy). Unused symbols cost as much as a symbol used once.
+func deflateStatisticalCosts(litLenFreqs []int, distFreqs []int) *deflateCosts {
+	costs := &deflateCosts{}
+	entropy := func(freqs []int, costs []float32) {
+		total := 0
+		for _, freq := range freqs {
+			total += freq
+		}
+		if total == 0 {
+			total = 1
+		}
+		log2Total := math.Log2(float64(total))
+		for sym, freq := range freqs {
+			if freq == 0 {
+				freq = 1
+			}
+			costs[sym] = float32(log2Total - math.Log2(float64(freq)))
+		}
+	}
+	entropy(litLenFreqs, costs.litLen[:])
+	entropy(distFreqs, costs.dist[:])
+	return costs
+}
+
+// Finds the cheapest parse of in using its matches and symbol costs
+func deflateParse(in []byte, matches []uint32, starts []int32, costs *deflateCosts) []deflateSymbol {
+	// Costs of each match length and distance including extra bits
+	var lengthCosts [deflateMaxMatch + 1]float32
+	for length := deflateMinMatch; length <= deflateMaxMatch; length++ {
+		sym := deflateLengthSymbols[length]
+		lengthCosts[length] = costs.litLen[257+int(sym)] + float32(deflateLengthExtra[sym])
+	}
+	var distCosts [30]float32
+	for sym := range distCosts {
+		distCosts[sym] = costs.dist[sym] + float32(deflateDistExtra[sym])
+	}
+
+	// Find the cheapest way to reach each position, going forwards
+	cost := make([]float32, len(in)+1)
+	for i := 1; i < len(cost); i++ {
+		cost[i] = math.MaxFloat32
+	}
+	lengths := make([]uint16, len(in)+1) // Length of the symbol ending at each position on the cheapest path
+	dists := make([]uint16, len(in)+1)
+	for i := 0; i < len(in); i++ {
+		if c := cost[i] + costs.litLen[in[i]]; c < cost[i+1] {
+			cost[i+1] = c
+			lengths[i+1] = 1
+			dists[i+1] = 0
+		}
+		length := deflateMinMatch
+		for _, match := range matches[starts[i]:starts[i+1]] {
+			dist := match & 0xffff
+			distCost := cost[i] + distCosts[deflateDistSymbols[dist]]
+			for ; length <= int(match>>16); length++ {
+				if c := distCost + lengthCosts[length]; c < cost[i+length] {
+					cost[i+length] = c
+					lengths[i+length] = uint16(length)
+					dists[i+length] = uint16(dist)
+				}
+			}
+		}
+	}
+
+	// Trace the cheapest path back from the end
+	count := 0
+	for i := len(in); i > 0; i -= int(lengths[i]) {
+		count++
+	}
+	symbols := make([]deflateSymbol, count)
+	for i := len(in); i > 0; i -= int(lengths[i]) {
+		count--
+		if dists[i] == 0 {
+			symbols[count] = deflateSymbol{uint16(in[i-1]), 0}
+		} else {
+			symbols[count] = deflateSymbol{lengths[i], dists[i]}
+		}
+	}
+	return symbols
+}
+
+// Counts the lit/len and distance symbols of a parse, including the end of block symbol
+func deflateSymbolFreqs(symbols []deflateSymbol) (litLenFreqs []int, distFreqs []int) {
+	litLenFreqs = make([]int, 286)
+	distFreqs = make([]int, 30)
+	for _, symbol := range symbols {
+		if symbol.dist == 0 {
+			litLenFreqs[symbol.length]++
+		} else {
+			litLenFreqs[257+int(deflateLengthSymbols[symbol.length])]++
+			distFreqs[deflateDistSymbols[symbol.dist]]++
+		}
+	}
+	litLenFreqs[deflateEndOfBlock]++
+	return litLenFreqs, distFreqs
+}
+
+/*** HUFFMAN CODES ***/
+// Node in the package-merge algorithm. Leaves have a symbol, packages have two children.
+type packageMergeNode struct {
+	weight int
+	symbol int
+	left, right *packageMergeNode
+}
+
+// Computes optimal Huffman code lengths of at most maxBits bits from symbol frequencies, using the package-merge algorithm.
+// Symbols with a frequency of 0 get no code. To keep every decoder happy, at least 2 symbols get a code if any are used.
+func huffmanCodeLengths(freqs []int, maxBits int) []uint8 {
+	lengths := make([]uint8, len(freqs))
+	var leaves []*packageMergeNode
+	for sym, freq := range freqs {
+		if freq > 0 {
+			leaves = append(leaves, &packageMergeNode{weight: freq, symbol: sym})
+		}
+	}
+	if len(leaves) == 0 {
+		return lengths
+	}
+	if len(leaves) == 1 {
+		lengths[leaves[0].symbol] = 1
+		if leaves[0].symbol == 0 {
+			lengths[1] = 1
+		} else {
+			lengths[0] = 1
+		}
+		return lengths
+	}
+	sort.SliceStable(leaves, func(i, j int) bool { return leaves[i].weight < leaves[j].weight })
+
+	// Package pairs of items, and merge the packages with the leaves, once for each bit of code length
+	list := leaves
+	for bits := 1; bits < maxBits; bits++ {
+		merged := make([]*packageMergeNode, 0, len(leaves)+len(list)/2)
+		l := 0
+		for i := 0; i+1 < len(list); i += 2 {
+			pkg := &packageMergeNode{weight: list[i].weight + list[i+1].weight, symbol: -1, left: list[i], right: list[i+1]}
+			for l < len(leaves) && leaves[l].weight <= pkg.weight {
+				merged = append(merged, leaves[l])
+				l++
+			}
+			merged = append(merged, pkg)
+		}
+		list = append(merged, leaves[l:]...)
+	}
+
+	// Each time a leaf appears in the first 2n-2 items, its code gets one bit longer
+	var count func(node *packageMergeNode)
+	count = func(node *packageMergeNode) {
+		if node.symbol >= 0 {
+			lengths[node.symbol]++
+		} else {
+			count(node.left)
+			count(node.right)
+		}
+	}
+	for _, node := range list[:2*len(leaves)-2] {
+		count(node)
+	}
+	return lengths
+}
+
+// Computes canonical Huffman codes from code lengths. Codes are bit reversed, since deflate writes them most significant bit first.
+func huffmanCodes(lengths []uint8) []uint16 {
+	var count [deflateMaxCodeBits + 1]int
+	for _, length := range lengths {
+		count[length]++
+	}
+	count[0] = 0
+	var next [deflateMaxCodeBits + 1]int
+	code := 0
+	for bits := 1; bits <= deflateMaxCodeBits; bits++ {
+		code = (code + count[bits-1]) << 1
+		next[bits] = code
+	}
+	codes := make([]uint16, len(lengths))
+	for sym, length := range lengths {
+		if length == 0 {
+			continue
+		}
+		code := next[length]
+		next[length]++
+		reversed := 0
+		for i := 0; i < int(length); i++ {
+			reversed = reversed<<1 | (code>>uint(i))&1
+		}
+		codes[sym] = uint16(reversed)
+	}
+	return codes
+}
+
+// Code lengths of the fixed lit/len Huffman code
+func deflateFixedLitLenLengths() []uint8 {
+	lengths := make([]uint8, 288)
+	for sym := range lengths {
+		switch {
+		case sym < 144:
+			lengths[sym] = 8
+		case sym < 256:
+			lengths[sym] = 9
+		case sym < 280:
+			lengths[sym] = 7
+		default:
+			lengths[sym] = 8
+		}
+	}
+	return lengths
+}
+
+/*** BLOCK WRITING ***/
+// Writes bits least significant bit first, as deflate does
+type deflateBitWriter struct {
+	out []byte
+	bits uint64
+	numBits uint
+}
+
+func (w *deflateBitWriter) writeBits(value uint32, numBits uint) {
+	w.bits |= uint64(value) << w.numBits
+	w.numBits += numBits
+	for w.numBits >= 8 {
+		w.out = append(w.out, byte(w.bits))
+		w.bits >>= 8
+		w.numBits -= 8
+	}
+}
+
+// Pads to a byte boundary with zero bits
+func (w *deflateBitWriter) alignByte() {
+	if w.numBits > 0 {
+		w.writeBits(0, 8-w.numBits)
+	}
+}
+
+// Writes symbols with the given Huffman codes, followed by the end of block symbol
+func (w *deflateBitWriter) writeSymbols(symbols []deflateSymbol, litLenLengths []uint8, distLengths []uint8) {
+	litLenCodes := huffmanCodes(litLenLengths)
+	distCodes := huffmanCodes(distLengths)
+	for _, symbol := range symbols {
+		if symbol.dist == 0 {
+			w.writeBits(uint32(litLenCodes[symbol.length]), uint(litLenLengths[symbol.length]))
+			continue
+		}
+		lengthSym := deflateLengthSymbols[symbol.length]
+		w.writeBits(uint32(litLenCodes[257+int(lengthSym)]), uint(litLenLengths[257+int(lengthSym)]))
+		w.writeBits(uint32(symbol.length-deflateLengthBase[lengthSym]), uint(deflateLengthExtra[lengthSym]))
+		distSym := deflateDistSymbols[symbol.dist]
+		w.writeBits(uint32(distCodes[distSym]), uint(distLengths[distSym]))
+		w.writeBits(uint32(symbol.dist-deflateDistBase[distSym]), uint(deflateDistExtra[distSym]))
+	}
+	w.writeBits(uint32(litLenCodes[deflateEndOfBlock]), uint(litLenLengths[deflateEndOfBlock]))
+}
+
+// Writes a final block with the fixed Huffman code
+func (w *deflateBitWriter) writeFixedBlock(symbols []deflateSymbol) {
+	w.writeBits(1, 1) // BFINAL
+	w.writeBits(1, 2) // BTYPE = fixed Huffman
+	distLengths := make([]uint8, 30)
+	for sym := range distLengths {
+		distLengths[sym] = 5
+	}
+	w.writeSymbols(symbols, deflateFixedLitLenLengths(), distLengths)
+}
+
+// Writes a final block with Huffman codes fitted to the symbols
+func (w *deflateBitWriter) writeDynamicBlock(symbols []deflateSymbol) {
+	litLenFreqs, distFreqs := deflateSymbolFreqs(symbols)
+	litLenLengths := huffmanCodeLengths(litLenFreqs, deflateMaxCodeBits)
+	distLengths := huffmanCodeLengths(distFreqs, deflateMaxCodeBits)
+
+	// Trim unused codes from the end of both codes
+	numLitLen := len(litLenLengths)
+	for numLitLen > 257 && litLenLengths[numLitLen-1] == 0 {
+		numLitLen--
+	}
+	numDist := len(distLengths)
+	for numDist > 1 && distLengths[numDist-1] == 0 {
+		numDist--
+	}
+
+	// Run length encode the code lengths of both codes with code length symbols 16 (repeat previous), 17 and 18 (repeat zero)
+	allLengths := append(append([]uint8{}, litLenLengths[:numLitLen]...), distLengths[:numDist]...)
+	type codeLengthSymbol struct {
+		symbol uint8
+		extra uint8
+	}
+	var rle []codeLengthSymbol
+	codeLengthFreqs := make([]int, 19)
+	for i := 0; i < len(allLengths); {
+		length := allLengths[i]
+		run := 1
+		for i+run < len(allLengths) && allLengths[i+run] == length {
+			run++
+		}
+		i += run
+		if length == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				rle = append(rle, codeLengthSymbol{18, uint8(n - 11)})
+				run -= n
+			}
+			if run >= 3 {
+				rle = append(rle, codeLengthSymbol{17, uint8(run - 3)})
+				run = 0
+			}
+		} else {
+			rle = append(rle, codeLengthSymbol{length, 0})
+			run--
+			for run >= 3 {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				rle = append(rle, codeLengthSymbol{16, uint8(n - 3)})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			rle = append(rle, codeLengthSymbol{length, 0})
+		}
+	}
+	for _, symbol := range rle {
+		codeLengthFreqs[symbol.symbol]++
+	}
+	codeLengthLengths := huffmanCodeLengths(codeLengthFreqs, deflateMaxCodeLengthBits)
+	codeLengthCodes := huffmanCodes(codeLengthLengths)
+	numCodeLength := len(deflateCodeLengthOrder)
+	for numCodeLength > 4 && codeLengthLengths[deflateCodeLengthOrder[numCodeLength-1]] == 0 {
+		numCodeLength--
+	}
+
+	// Write header
+	w.writeBits(1, 1) // BFINAL
+	w.writeBits(2, 2) // BTYPE = dynamic Huffman
+	w.writeBits(uint32(numLitLen-257), 5)
+	w.writeBits(uint32(numDist-1), 5)
+	w.writeBits(uint32(numCodeLength-4), 4)
+	for _, sym := range deflateCodeLengthOrder[:numCodeLength] {
+		w.writeBits(uint32(codeLengthLengths[sym]), 3)
+	}
+	for _, symbol := range rle {
+		w.writeBits(uint32(codeLengthCodes[symbol.symbol]), uint(codeLengthLengths[symbol.symbol]))
+		switch symbol.symbol {
+		case 16:
+			w.writeBits(uint32(symbol.extra), 2)
+		case 17:
+			w.writeBits(uint32(symbol.extra), 3)
+		case 18:
+			w.writeBits(uint32(symbol.extra), 7)
+		}
+	}
+
+	// Write data
+	w.writeSymbols(symbols, litLenLengths, distLengths)
+}
+
+// Writes in as stored blocks, the last of which is final
+func (w *deflateBitWriter) writeStoredBlocks(in []byte) {
+	for {
+		n := len(in)
+		if n > deflateMaxStoredBlock {
+			n = deflateMaxStoredBlock
+		}
+		final := uint32(0)
+		if n == len(in) {
+			final = 1
+		}
+		w.writeBits(final, 1)
+		w.writeBits(0, 2) // BTYPE = stored
+		w.alignByte()
+		w.writeBits(uint32(n), 16)
+		w.writeBits(uint32(^uint16(n)), 16)
+		w.out = append(w.out, in[:n]...)
+		in = in[n:]
+		if final == 1 {
+			return
+		}
+	}
+}
+
+// Size in bytes of symbols written as a dynamic block
+func deflateDynamicBlockSize(symbols []deflateSymbol) int {
+	var w deflateBitWriter
+	w.writeDynamicBlock(symbols)
+	w.alignByte()
+	return len(w.out)
+}
+
+/*** COMPRESSION ***/
+// Compresses in to a raw deflate stream, trying hard to make it as small as possible
+func deflateOptimal(in []byte) []byte {
+	// Find the best parse, updating symbol costs from each parse for the next one
+	matches, starts := deflateFindMatches(in)
+	costs := deflateFixedCosts()
+	var best []deflateSymbol
+	bestSize := 0
+	for i := 0; i < deflateIterations; i++ {
+		symbols := deflateParse(in, matches, starts, costs)
+		size := deflateDynamicBlockSize(symbols)
+		if best == nil || size < bestSize {
+			best, bestSize = symbols, size
+		}
+		costs = deflateStatisticalCosts(deflateSymbolFreqs(symbols))
+	}
+
+	// Write the parse in whichever block type is smallest
+	var dynamic, fixed, stored deflateBitWriter
+	dynamic.writeDynamicBlock(best)
+	dynamic.alignByte()
+	fixed.writeFixedBlock(deflateParse(in, matches, starts, deflateFixedCosts()))
+	fixed.alignByte()
+	stored.writeStoredBlocks(in)
+	out := dynamic.out
+	if len(fixed.out) < len(out) {
+		out = fixed.out
+	}
+	if len(stored.out) < len(out) {
+		out = stored.out
+	}
+	return out
+}
+
+// Compresses in to a gzip member with optimal deflate. The header is the same as compress/gzip writes at its best compression level.
+func gzipOptimal(in []byte) []byte {
+	out := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 2, 0xff}
+	out = append(out, deflateOptimal(in)...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(in))
+	return binary.LittleEndian.AppendUint32(out, uint32(len(in)))
+}
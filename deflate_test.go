@@ -0,0 +1,74 @@
+package press
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+)
+
+func TestHuffmanCodeLengths(t *testing.T) {
+	// Fibonacci frequencies make the unlimited Huffman code as deep as possible
+	freqs := make([]int, 30)
+	freqs[0], freqs[1] = 1, 1
+	for i := 2; i < len(freqs); i++ {
+		freqs[i] = freqs[i-1] + freqs[i-2]
+	}
+	for _, maxBits := range []int{deflateMaxCodeLengthBits, deflateMaxCodeBits} {
+		lengths := huffmanCodeLengths(freqs, maxBits)
+
+		// Code lengths should be limited, and the code should be complete (Kraft sum of exactly 1)
+		kraft := 0
+		for _, length := range lengths {
+			if length == 0 || int(length) > maxBits {
+				t.Fatalf("Code length %d with a limit of %d bits", length, maxBits)
+			}
+			kraft += 1 << uint(maxBits-int(length))
+		}
+		if kraft != 1<<uint(maxBits) {
+			t.Fatalf("Code with a limit of %d bits is not complete", maxBits)
+		}
+	}
+}
+
+func TestGzipOptimalRoundTrip(t *testing.T) {
+	for _, data := range lz4TestInputs() {
+		compressed := gzipOptimal(data)
+		var decompressed bytes.Buffer
+		if _, err := decompressBlockRangeGz(bytes.NewReader(compressed), &decompressed); err != nil {
+			t.Fatalf("Length %d: %v", len(data), err)
+		}
+		if !bytes.Equal(decompressed.Bytes(), data) {
+			t.Fatalf("Length %d: Decompressed data doesn't match original data", len(data))
+		}
+
+		// Compressible data should be smaller than with compress/gzip's best compression
+		var b bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&b, gzip.BestCompression)
+		gz.Write(data)
+		gz.Close()
+		if len(compressed) > b.Len() {
+			t.Fatalf("Length %d: Compressed to %d bytes, compress/gzip compressed to %d bytes", len(data), len(compressed), b.Len())
+		}
+	}
+}
+
+func TestGzipOptimalBinary(t *testing.T) {
+	binPath, err := exec.LookPath("gzip")
+	if err != nil {
+		t.Skip("gzip binary not found")
+	}
+	for _, data := range lz4TestInputs() {
+		cmd := exec.Command(binPath, "-dc")
+		cmd.Stdin = bytes.NewReader(gzipOptimal(data))
+		cmd.Stderr = ioutil.Discard
+		decompressed, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Length %d: %v", len(data), err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("Length %d: Data decompressed by gzip binary doesn't match original data", len(data))
+		}
+	}
+}
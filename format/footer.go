@@ -0,0 +1,116 @@
+package format
+
+import (
+	"bytes"
+	"errors"
+)
+
+/*** FILE FOOTER ***/
+// The footer is stored as the extra data of the last (empty) gzip file in the stream. It makes the file self-describing,
+// so that it can be decompressed without knowing the compression mode and block size it was compressed with.
+// Files written before the footer existed (version 0) end with a gzip file storing only the 4-byte length of the
+// block data gzip files instead.
+var FooterMagic = []byte{'P', 'R', 'E', 'S'} // Magic bytes at the very end of the footer
+const FooterVersion = 2 // Current version of the file format. Version 1 used 32-bit lengths and a plain list of block sizes.
+const FooterSize = 34 // Size of the footer record itself
+const FooterSizeV1 = 18 // Size of the footer record in version 1 files
+const FooterTrailingBytes = GzipHeaderSize+2+FooterSize+GzipDataAndFooterSize // Total size of the gzip file containing the footer
+
+// Constants for files without a footer
+const LengthOffsetFromEnd = GzipDataAndFooterSize+4 // How far the 4-byte length of gzipped data is from the end
+const TrailingBytes = LengthOffsetFromEnd+2+GzipHeaderSize // This is the total size of the last gzip file in the stream, which is not included in the length of gzipped data
+
+// Contents of the footer (little endian). In version 2, these are stored in the following order:
+// uint64 BlockDataLen, uint64 DecompressedSize, uint32 BlockSize, uint64 NumBlocks, uint8 CodecID, uint8 Version, magic.
+// Version 1 only has uint32 BlockDataLen, uint32 BlockSize, uint32 NumBlocks, uint8 CodecID, uint8 Version and magic.
+type Footer struct {
+	BlockDataLen uint64 // Total length of the gzip files containing block data
+	DecompressedSize uint64 // Decompressed size of the file (version 2+)
+	BlockSize uint32 // Uncompressed size of each block (except for the last one), or the maximum size of variable-size blocks
+	NumBlocks uint64 // Number of blocks
+	CodecID uint8 // Stable ID of the codec used to compress the blocks
+	Version uint8 // Version of the file format. 0 means the file has no footer.
+}
+
+// Gets the size of the footer record for a version of the file format
+func footerSizeForVersion(version uint8) int {
+	if version == 1 {
+		return FooterSizeV1
+	}
+	return FooterSize
+}
+
+// Gets the total size of the gzip file containing the footer
+func (f *Footer) TrailingBytes() int64 {
+	if f.Version == 0 {
+		return TrailingBytes
+	}
+	return int64(GzipHeaderSize+2+footerSizeForVersion(f.Version)+GzipDataAndFooterSize)
+}
+
+// Encodes the footer into the gzip file it is stored in, using the version of the footer
+func (f *Footer) Encode() []byte {
+	record := make([]byte, 0, FooterSize)
+	switch f.Version {
+		case 0: return EncodeExtraGzip(uint32ToBytes(uint32(f.BlockDataLen)))
+		case 1:
+			record = append(record, uint32ToBytes(uint32(f.BlockDataLen))...)
+			record = append(record, uint32ToBytes(f.BlockSize)...)
+			record = append(record, uint32ToBytes(uint32(f.NumBlocks))...)
+		default:
+			record = append(record, uint64ToBytes(f.BlockDataLen)...)
+			record = append(record, uint64ToBytes(f.DecompressedSize)...)
+			record = append(record, uint32ToBytes(f.BlockSize)...)
+			record = append(record, uint64ToBytes(f.NumBlocks)...)
+	}
+	record = append(record, f.CodecID, f.Version)
+	record = append(record, FooterMagic...)
+	return EncodeExtraGzip(record)
+}
+
+// Decodes the footer from the end of a file. Files without a footer are decoded as a version 0 footer, which only
+// has BlockDataLen. At least FooterTrailingBytes should be passed, unless the file is smaller than that.
+func DecodeFooter(data []byte) (*Footer, error) {
+	// Check for the magic bytes and get the version
+	f := new(Footer)
+	end := len(data)-GzipDataAndFooterSize // End of the footer record
+	if end >= 5 && bytes.Equal(data[end-4:end], FooterMagic) && data[end-5] != 0 {
+		f.Version = data[end-5]
+		if f.Version > FooterVersion {
+			return nil, errors.New("File was written by a newer version of the file format")
+		}
+	}
+
+	// Check that the footer is in a gzip file that looks like ours. If not, this is a file without a footer.
+	if f.Version != 0 {
+		recordSize := footerSizeForVersion(f.Version)
+		start := end-recordSize // Start of the footer record
+		if start < GzipHeaderSize+2 || !bytes.Equal(data[start-2-GzipHeaderSize:start-2], GzipHeaderData) ||
+		   int(bytesToUint16(data[start-2:start])) != recordSize {
+			f.Version = 0
+		}
+	}
+
+	// Decode the footer
+	switch f.Version {
+		case 0:
+			if len(data) < TrailingBytes {
+				return nil, errors.New("File is too small to contain block data; file may be corrupted")
+			}
+			f.BlockDataLen = uint64(bytesToUint32(data[len(data)-LengthOffsetFromEnd:]))
+		case 1:
+			record := data[end-FooterSizeV1:end]
+			f.BlockDataLen = uint64(bytesToUint32(record[0:4]))
+			f.BlockSize = bytesToUint32(record[4:8])
+			f.NumBlocks = uint64(bytesToUint32(record[8:12]))
+			f.CodecID = record[12]
+		default:
+			record := data[end-FooterSize:end]
+			f.BlockDataLen = bytesToUint64(record[0:8])
+			f.DecompressedSize = bytesToUint64(record[8:16])
+			f.BlockSize = bytesToUint32(record[16:20])
+			f.NumBlocks = bytesToUint64(record[20:28])
+			f.CodecID = record[28]
+	}
+	return f, nil
+}
@@ -0,0 +1,118 @@
+// Package format defines the on-disk layout of files written by press, along with functions to encode and decode it.
+//
+// A file consists of:
+//   * compressed blocks, concatenated into a single stream
+//   * empty gzip files containing block data (an Index, gzipped and then split among extra data fields)
+//   * an empty gzip file containing the Footer in its extra data field
+// With a sidecar index, the block data and footer gzip files are stored in a separate object instead.
+package format
+
+import (
+	"io"
+	"bytes"
+	"errors"
+)
+
+// Stable codec IDs stored in the footer. These must never be renumbered.
+const (
+	CodecGzip = 1 // All gzip modes
+	CodecXzInGz = 2 // All xz-in-gzip modes
+	CodecLz4 = 3
+	CodecSnappy = 4
+	CodecZstd = 5 // All zstd modes, except for the zstd seekable format
+	CodecBrotli = 6 // All brotli modes
+	CodecBzip2 = 7 // All bzip2 modes
+	CodecLzma = 8 // Raw LZMA (.lzma files)
+	CodecBgzf = 9 // BGZF (blocked gzip, as used by htslib)
+	CodecXz = 10 // Blocks of a multi-block .xz file
+	CodecZstdSeekable = 11 // Frames of a seekable zstd file
+)
+
+/*** BYTE CONVERSION FUNCTIONS ***/
+// Converts uint16 to bytes (little endian)
+func uint16ToBytes(n uint16) []byte {
+	return []byte{byte(n&0xff), byte(n>>8)}
+}
+
+// Converts bytes to uint16 (little endian)
+func bytesToUint16(n []byte) uint16 {
+	return uint16(n[0])+(uint16(n[1])<<8)
+}
+
+// Converts uint32 to bytes (little endian)
+func uint32ToBytes(n uint32) []byte {
+	return append(uint16ToBytes(uint16(n&0xffff)), uint16ToBytes(uint16(n>>16))...)
+}
+
+// Converts bytes to uint32 (little endian)
+func bytesToUint32(n []byte) uint32 {
+	res := uint32(0)
+	for i := 3; i>=0; i-- {
+		res <<= 8
+		res += uint32(n[i])
+	}
+	return res
+}
+
+// Converts uint64 to bytes (little endian)
+func uint64ToBytes(n uint64) []byte {
+	return append(uint32ToBytes(uint32(n&0xffffffff)), uint32ToBytes(uint32(n>>32))...)
+}
+
+// Converts bytes to uint64 (little endian)
+func bytesToUint64(n []byte) uint64 {
+	return uint64(bytesToUint32(n[0:4]))+(uint64(bytesToUint32(n[4:8]))<<32)
+}
+
+/*** GZIP FILES WITH EXTRA DATA ***/
+// These should be constant
+var GzipHeaderData = []byte{0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03} // A gzip header that allows for extra data
+var GzipContentAndFooter = []byte{0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00} // Empty gzip content and footer
+// Size of gzip header and footer for gzip files that are storing block data in extra data fields
+const GzipHeaderSize = 10
+const GzipDataAndFooterSize = 10
+const MaxExtraDataSize = 65535 // Maximum size of extra data in a single gzip file
+
+// Creates an empty gzip file with extra data
+func EncodeExtraGzip(extraData []byte) []byte {
+	gzipFile := make([]byte, 0, GzipHeaderSize+2+len(extraData)+GzipDataAndFooterSize)
+	gzipFile = append(append(gzipFile, GzipHeaderData...), uint16ToBytes(uint16(len(extraData)))...)
+	return append(append(gzipFile, extraData...), GzipContentAndFooter...)
+}
+
+// Splits data into extra data in empty gzip files. Returns the total length of all the gzip files written.
+func Extraify(in []byte, out io.Writer) (totalLength uint64, err error) {
+	// Loop through the data, splitting it into up to 65535-byte chunks, then adding it to an empty gzip file as extra data
+	for len(in) > 0 {
+		n := len(in) // n is the length of the extra data that will be added
+		if n > MaxExtraDataSize {
+			n = MaxExtraDataSize
+		}
+		gzipFile := EncodeExtraGzip(in[:n])
+		_, err = out.Write(gzipFile)
+		if err != nil {
+			return totalLength, err
+		}
+		totalLength += uint64(len(gzipFile))
+		in = in[n:]
+	}
+	return totalLength, nil
+}
+
+// Joins the extra data of a list of empty gzip files created by Extraify
+func Unextraify(data []byte) ([]byte, error) {
+	joined := make([]byte, 0)
+	for len(data) > 0 {
+		if len(data) < GzipHeaderSize+2+GzipDataAndFooterSize || !bytes.Equal(data[:GzipHeaderSize], GzipHeaderData) {
+			return nil, errors.New("Block data isn't stored in gzip extra data fields; file may be corrupted")
+		}
+		extraDataLen := int(bytesToUint16(data[GzipHeaderSize:GzipHeaderSize+2]))
+		gzipFileLen := GzipHeaderSize+2+extraDataLen+GzipDataAndFooterSize
+		if len(data) < gzipFileLen {
+			return nil, errors.New("Block data gzip file is truncated; file may be corrupted")
+		}
+		joined = append(joined, data[GzipHeaderSize+2:GzipHeaderSize+2+extraDataLen]...)
+		data = data[gzipFileLen:]
+	}
+	return joined, nil
+}
@@ -0,0 +1,204 @@
+package format
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Conformance vectors. The golden files are regenerated by the press package (see golden_test.go there).
+var vectors = []struct {
+	name string
+	footer Footer
+	blockSizes []uint64
+	uncompressedSizes []uint64
+	blockFlags []byte
+	numHashes int
+	hasMetadata bool
+}{
+	{"gzip-store.press", Footer{134, 40000, 16384, 3, CodecGzip, 2}, []uint64{16409, 16409, 7257}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"gzip-min.press", Footer{134, 40000, 16384, 3, CodecGzip, 2}, []uint64{2896, 2941, 1337}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"gzip-default.press", Footer{134, 40000, 16384, 3, CodecGzip, 2}, []uint64{2299, 2332, 1082}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"gzip-max.press", Footer{134, 40000, 16384, 3, CodecGzip, 2}, []uint64{1857, 1888, 925}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"xz-min.press", Footer{134, 40000, 16384, 3, CodecXzInGz, 2}, []uint64{2345, 2369, 1157}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"xz-default.press", Footer{134, 40000, 16384, 3, CodecXzInGz, 2}, []uint64{2345, 2369, 1157}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"lz4.press", Footer{134, 40000, 16384, 3, CodecLz4, 2}, []uint64{6169, 6241, 2761}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"snappy.press", Footer{134, 40000, 16384, 3, CodecSnappy, 2}, []uint64{4604, 4633, 2084}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"snappy-raw.press", Footer{134, 40000, 16384, 3, CodecSnappy, 2}, []uint64{4586, 4615, 2066}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"zstd-default.press", Footer{134, 40000, 16384, 3, CodecZstd, 2}, []uint64{2393, 2405, 1122}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"brotli-default.press", Footer{134, 40000, 16384, 3, CodecBrotli, 2}, []uint64{2094, 2123, 982}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"bzip2.press", Footer{134, 40000, 16384, 3, CodecBzip2, 2}, []uint64{1289, 1300, 652}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"lzma.press", Footer{134, 40000, 16384, 3, CodecLzma, 2}, []uint64{2268, 2293, 1080}, []uint64{16384, 16384, 7232}, nil, 0, false},
+	{"stored.press", Footer{101, 40000, 16384, 3, CodecGzip, 2}, []uint64{16384, 16384, 7232}, []uint64{16384, 16384, 7232}, []byte{1, 1, 1}, 0, false},
+	{"cdc-hashes-metadata.press", Footer{217, 40000, 16384, 4, CodecGzip, 2}, []uint64{2049, 2922, 786, 1510}, []uint64{11484, 16384, 3892, 8240}, nil, 2, true},
+	{"v1.press", Footer{63, 0, 16384, 3, CodecGzip, 1}, []uint64{2299, 2332, 1082}, nil, nil, 0, false},
+	{"v0.press", Footer{63, 0, 0, 0, 0, 0}, []uint64{2299, 2332, 1082}, nil, nil, 0, false},
+}
+
+// Conformance vectors for files in formats of their own (such as BGZF), whose block data and footer are in a sidecar index
+var sidecarVectors = []struct {
+	name string // Name of the compressed file. The sidecar index is named after it with ".index".
+	containerTrailerLen uint64 // Size of what the format has after the blocks (such as the BGZF end-of-file marker)
+	footer Footer
+	blockSizes []uint64
+	uncompressedSizes []uint64
+}{
+	{"bgzf.bgz", 28, Footer{134, 40000, 16384, 3, CodecBgzf, 2}, []uint64{2307, 2340, 1090}, []uint64{16384, 16384, 7232}},
+	{"zstd-seekable.zst", 41, Footer{134, 40000, 16384, 3, CodecZstdSeekable, 2}, []uint64{2393, 2405, 1122}, []uint64{16384, 16384, 7232}},
+	{"xz.xz", 32, Footer{134, 40000, 16384, 3, CodecXz, 2}, []uint64{2300, 2312, 1100}, []uint64{16384, 16384, 7232}},
+}
+
+// Checks that re-encoding the footer and block data of a trailer (block data followed by the footer) gives the same bytes
+func checkReEncodedTrailer(t *testing.T, name string, trailer []byte, footer *Footer, idx *Index) {
+	trailingBytes := uint64(footer.TrailingBytes())
+	if footer.BlockDataLen+trailingBytes != uint64(len(trailer)) {
+		t.Fatalf("%s: Block data and footer don't add up to the trailer size", name)
+	}
+	if !bytes.Equal(footer.Encode(), trailer[footer.BlockDataLen:]) {
+		t.Fatalf("%s: Re-encoded footer doesn't match", name)
+	}
+	gzippedBlockData, err := Unextraify(trailer[:footer.BlockDataLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(gzippedBlockData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockData, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(idx.Encode(footer.Version), blockData) {
+		t.Fatalf("%s: Re-encoded block data doesn't match", name)
+	}
+}
+
+// Sum of block sizes
+func blocksLen(idx *Index) uint64 {
+	total := uint64(0)
+	for _, blockSize := range idx.BlockSizes {
+		total += blockSize
+	}
+	return total
+}
+
+func TestConformance(t *testing.T) {
+	for _, vector := range vectors {
+		file, err := ioutil.ReadFile(filepath.Join("testdata", vector.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		footer, idx, err := ReadTrailer(bytes.NewReader(file), int64(len(file)))
+		if err != nil {
+			t.Fatalf("%s: %v", vector.name, err)
+		}
+
+		// Check decoded fields
+		if *footer != vector.footer {
+			t.Fatalf("%s: Footer is %+v, expected %+v", vector.name, *footer, vector.footer)
+		}
+		if !reflect.DeepEqual(idx.BlockSizes, vector.blockSizes) {
+			t.Fatalf("%s: Block sizes are %v, expected %v", vector.name, idx.BlockSizes, vector.blockSizes)
+		}
+		if !reflect.DeepEqual(idx.UncompressedSizes, vector.uncompressedSizes) {
+			t.Fatalf("%s: Uncompressed sizes are %v, expected %v", vector.name, idx.UncompressedSizes, vector.uncompressedSizes)
+		}
+		if !bytes.Equal(idx.BlockFlags, vector.blockFlags) {
+			t.Fatalf("%s: Block flags are %v, expected %v", vector.name, idx.BlockFlags, vector.blockFlags)
+		}
+		if len(idx.Hashes) != vector.numHashes || (idx.Metadata != nil) != vector.hasMetadata {
+			t.Fatalf("%s: Got %d hashes and metadata %+v", vector.name, len(idx.Hashes), idx.Metadata)
+		}
+		if footer.Version >= 2 && len(idx.Checksums) != len(idx.BlockSizes) {
+			t.Fatalf("%s: Got %d checksums for %d blocks", vector.name, len(idx.Checksums), len(idx.BlockSizes))
+		}
+
+		// Blocks, block data and footer should make up the whole file, and re-encoding them should give the same bytes
+		if blocksLen(idx) > uint64(len(file)) {
+			t.Fatalf("%s: Blocks are larger than the file", vector.name)
+		}
+		checkReEncodedTrailer(t, vector.name, file[blocksLen(idx):], footer, idx)
+	}
+}
+
+func TestSidecarConformance(t *testing.T) {
+	for _, vector := range sidecarVectors {
+		file, err := ioutil.ReadFile(filepath.Join("testdata", vector.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		index, err := ioutil.ReadFile(filepath.Join("testdata", vector.name+".index"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		footer, idx, err := ReadTrailer(bytes.NewReader(index), int64(len(index)))
+		if err != nil {
+			t.Fatalf("%s: %v", vector.name, err)
+		}
+
+		// Check decoded fields
+		if *footer != vector.footer {
+			t.Fatalf("%s: Footer is %+v, expected %+v", vector.name, *footer, vector.footer)
+		}
+		if !reflect.DeepEqual(idx.BlockSizes, vector.blockSizes) {
+			t.Fatalf("%s: Block sizes are %v, expected %v", vector.name, idx.BlockSizes, vector.blockSizes)
+		}
+		if !reflect.DeepEqual(idx.UncompressedSizes, vector.uncompressedSizes) {
+			t.Fatalf("%s: Uncompressed sizes are %v, expected %v", vector.name, idx.UncompressedSizes, vector.uncompressedSizes)
+		}
+		if idx.BlockFlags != nil || len(idx.Checksums) != len(idx.BlockSizes) {
+			t.Fatalf("%s: Got block flags %v and %d checksums for %d blocks", vector.name, idx.BlockFlags, len(idx.Checksums), len(idx.BlockSizes))
+		}
+
+		// Blocks and what the format has after them should make up the compressed file, and the index should only have block data and footer
+		if blocksLen(idx)+vector.containerTrailerLen != uint64(len(file)) {
+			t.Fatalf("%s: Blocks don't add up to the file size", vector.name)
+		}
+		checkReEncodedTrailer(t, vector.name, index, footer, idx)
+	}
+}
+
+func TestUnknownRequiredSection(t *testing.T) {
+	footer := &Footer{NumBlocks: 1, DecompressedSize: 10, BlockSize: 10, CodecID: CodecGzip, Version: FooterVersion}
+	idx := &Index{BlockSizes: []uint64{20}}
+
+	// Unknown optional sections are skipped, but unknown required sections are an error
+	blockData := appendSection(idx.Encode(footer.Version), 0x7f, []byte{1, 2, 3})
+	if _, err := DecodeIndex(blockData, footer); err != nil {
+		t.Fatal(err)
+	}
+	blockData = appendSection(idx.Encode(footer.Version), 0xff, []byte{1, 2, 3})
+	if _, err := DecodeIndex(blockData, footer); err == nil {
+		t.Fatal("Unknown required section wasn't rejected")
+	}
+}
+
+func TestTruncatedTrailer(t *testing.T) {
+	file, err := ioutil.ReadFile(filepath.Join("testdata", "gzip-default.press"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int{1, FooterTrailingBytes, FooterTrailingBytes+10} {
+		truncated := file[:len(file)-cut]
+		if _, _, err := ReadTrailer(bytes.NewReader(truncated), int64(len(truncated))); err == nil {
+			t.Fatalf("Trailer truncated by %d bytes wasn't rejected", cut)
+		}
+	}
+}
+
+func TestCorruptNumBlocks(t *testing.T) {
+	idx := &Index{BlockSizes: []uint64{20}}
+	blockData := idx.Encode(FooterVersion)
+
+	// Numbers of blocks that overflow when multiplied by the size of a block size should still be rejected
+	for _, numBlocks := range []uint64{0, 2, 1<<61 + 1, 1<<62 + 1, 1<<63 + 1} {
+		footer := &Footer{NumBlocks: numBlocks, DecompressedSize: 10, BlockSize: 10, CodecID: CodecGzip, Version: FooterVersion}
+		if _, err := DecodeIndex(blockData, footer); err == nil {
+			t.Fatalf("Footer with %d blocks wasn't rejected", numBlocks)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package format
+
+import (
+	"errors"
+)
+
+/*** BLOCK INDEX ***/
+// Starting with version 2 of the file format, the block data is a list of sections, each of which is a uint8 tag,
+// a uint64 length, and the section data. New kinds of sections can be added without changing the version.
+// Sections with the high bit set in their tag are required to read the file.
+// In older versions, the block data is a list of uint32 block sizes followed by the uint32 uncompressed size of the last block.
+const (
+	SectionBlockSizes = 0x81 // Compressed size of each block (uint64 each)
+	SectionChecksums = 0x02 // CRC-32C of the uncompressed content of each block (uint32 each)
+	SectionHashes = 0x03 // Hashes of the whole uncompressed file (uint8 hash type, uint8 length and digest each)
+	SectionUncompressedSizes = 0x84 // Uncompressed size of each block (uint64 each)
+	SectionBlockFlags = 0x85 // Flags of each block (uint8 each)
+	SectionMetadata = 0x06 // Attributes of the original file (see Metadata)
+)
+const sectionRequired = 0x80
+const sectionHeaderSize = 9
+
+// Block flags
+const (
+	BlockFlagStored = 0x01 // Block is stored uncompressed because it didn't compress well
+)
+
+// Hash of the whole uncompressed file
+type Hash struct {
+	Type uint8 // Hash type (defined by press)
+	Digest []byte
+}
+
+// Decoded block data
+type Index struct {
+	BlockSizes []uint64 // Compressed size of each block
+	UncompressedSizes []uint64 // Uncompressed size of each block, or nil for files with fixed-size blocks
+	LastBlockSize uint64 // Uncompressed size of the last block (versions 0 and 1 only)
+	Checksums []uint32 // CRC-32C of the uncompressed content of each block, or nil
+	BlockFlags []uint8 // Flags of each block, or nil if no block has any flags
+	Hashes []Hash // Hashes of the whole uncompressed file
+	Metadata *Metadata // Attributes of the original file, or nil
+}
+
+// Appends a section to block data
+func appendSection(blockData []byte, tag uint8, data []byte) []byte {
+	blockData = append(blockData, tag)
+	blockData = append(blockData, uint64ToBytes(uint64(len(data)))...)
+	return append(blockData, data...)
+}
+
+// Checks whether we know how to handle a section
+func knownSection(tag uint8) bool {
+	switch tag {
+		case SectionBlockSizes: fallthrough
+		case SectionChecksums: fallthrough
+		case SectionHashes: fallthrough
+		case SectionUncompressedSizes: fallthrough
+		case SectionBlockFlags: fallthrough
+		case SectionMetadata: return true
+	}
+	return false
+}
+
+// Splits block data into sections
+func splitSections(blockData []byte) (sections map[uint8][]byte, err error) {
+	sections = make(map[uint8][]byte)
+	for len(blockData) > 0 {
+		if len(blockData) < sectionHeaderSize {
+			return nil, errors.New("Block data section is truncated; file may be corrupted")
+		}
+		tag := blockData[0]
+		sectionLen := bytesToUint64(blockData[1:sectionHeaderSize])
+		if sectionLen > uint64(len(blockData)-sectionHeaderSize) {
+			return nil, errors.New("Block data section is truncated; file may be corrupted")
+		}
+		if tag&sectionRequired != 0 && !knownSection(tag) {
+			return nil, errors.New("Block data contains a section from a newer version of the file format")
+		}
+		sections[tag] = blockData[sectionHeaderSize:sectionHeaderSize+sectionLen]
+		blockData = blockData[sectionHeaderSize+sectionLen:]
+	}
+	return sections, nil
+}
+
+// Encodes block data for a version of the file format. Sections are only written for fields that are set.
+func (idx *Index) Encode(version uint8) []byte {
+	blockData := make([]byte, 0)
+	if version < 2 {
+		for _, blockSize := range idx.BlockSizes {
+			blockData = append(blockData, uint32ToBytes(uint32(blockSize))...)
+		}
+		return append(blockData, uint32ToBytes(uint32(idx.LastBlockSize))...)
+	}
+
+	blockSizes := make([]byte, 0, len(idx.BlockSizes)*8)
+	for _, blockSize := range idx.BlockSizes {
+		blockSizes = append(blockSizes, uint64ToBytes(blockSize)...)
+	}
+	blockData = appendSection(blockData, SectionBlockSizes, blockSizes)
+	if idx.UncompressedSizes != nil {
+		uncompressedSizes := make([]byte, 0, len(idx.UncompressedSizes)*8)
+		for _, uncompressedSize := range idx.UncompressedSizes {
+			uncompressedSizes = append(uncompressedSizes, uint64ToBytes(uncompressedSize)...)
+		}
+		blockData = appendSection(blockData, SectionUncompressedSizes, uncompressedSizes)
+	}
+	if idx.Checksums != nil {
+		checksums := make([]byte, 0, len(idx.Checksums)*4)
+		for _, checksum := range idx.Checksums {
+			checksums = append(checksums, uint32ToBytes(checksum)...)
+		}
+		blockData = appendSection(blockData, SectionChecksums, checksums)
+	}
+	if idx.BlockFlags != nil {
+		blockData = appendSection(blockData, SectionBlockFlags, idx.BlockFlags)
+	}
+	if len(idx.Hashes) > 0 {
+		hashes := make([]byte, 0)
+		for _, hash := range idx.Hashes {
+			hashes = append(append(hashes, hash.Type, uint8(len(hash.Digest))), hash.Digest...)
+		}
+		blockData = appendSection(blockData, SectionHashes, hashes)
+	}
+	if idx.Metadata != nil {
+		blockData = appendSection(blockData, SectionMetadata, idx.Metadata.Encode())
+	}
+	return blockData
+}
+
+// Decodes block data. The footer is needed to know the version and number of blocks.
+func DecodeIndex(blockData []byte, footer *Footer) (*Index, error) {
+	if footer.Version < 2 {
+		return decodeIndexV1(blockData, footer)
+	}
+	idx := new(Index)
+	sections, err := splitSections(blockData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get block sizes. The number of blocks is checked before it is multiplied, so that a corrupt footer can't overflow it.
+	blockSizes := sections[SectionBlockSizes]
+	if footer.NumBlocks == 0 || footer.NumBlocks > uint64(len(blockSizes))/8 || uint64(len(blockSizes)) != footer.NumBlocks*8 {
+		return nil, errors.New("Number of blocks in block data doesn't match footer; file may be corrupted")
+	}
+	idx.BlockSizes = make([]uint64, footer.NumBlocks)
+	for i := range idx.BlockSizes {
+		idx.BlockSizes[i] = bytesToUint64(blockSizes[i*8:i*8+8])
+	}
+
+	// Get uncompressed block sizes. Files without them have fixed-size blocks.
+	if uncompressedSizes, ok := sections[SectionUncompressedSizes]; ok {
+		if uint64(len(uncompressedSizes)) != footer.NumBlocks*8 {
+			return nil, errors.New("Number of uncompressed block sizes doesn't match footer; file may be corrupted")
+		}
+		idx.UncompressedSizes = make([]uint64, footer.NumBlocks)
+		total := uint64(0)
+		for i := range idx.UncompressedSizes {
+			idx.UncompressedSizes[i] = bytesToUint64(uncompressedSizes[i*8:i*8+8])
+			total += idx.UncompressedSizes[i]
+		}
+		if total != footer.DecompressedSize {
+			return nil, errors.New("Uncompressed block sizes don't add up to decompressed size; file may be corrupted")
+		}
+	}
+
+	// Get flags of blocks
+	if blockFlags, ok := sections[SectionBlockFlags]; ok {
+		if uint64(len(blockFlags)) != footer.NumBlocks {
+			return nil, errors.New("Number of block flags doesn't match footer; file may be corrupted")
+		}
+		idx.BlockFlags = blockFlags
+	}
+
+	// Get checksums of blocks
+	if checksums, ok := sections[SectionChecksums]; ok {
+		if uint64(len(checksums)) != footer.NumBlocks*4 {
+			return nil, errors.New("Number of block checksums doesn't match footer; file may be corrupted")
+		}
+		idx.Checksums = make([]uint32, footer.NumBlocks)
+		for i := range idx.Checksums {
+			idx.Checksums[i] = bytesToUint32(checksums[i*4:i*4+4])
+		}
+	}
+
+	// Get hashes of the whole file
+	hashes := sections[SectionHashes]
+	for len(hashes) > 0 {
+		if len(hashes) < 2 || len(hashes) < 2+int(hashes[1]) {
+			return nil, errors.New("Hash section is truncated; file may be corrupted")
+		}
+		idx.Hashes = append(idx.Hashes, Hash{hashes[0], hashes[2:2+int(hashes[1])]})
+		hashes = hashes[2+int(hashes[1]):]
+	}
+
+	// Get metadata
+	if metadata, ok := sections[SectionMetadata]; ok {
+		idx.Metadata, err = DecodeMetadata(metadata)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// Decodes block data from files written before version 2 of the file format
+func decodeIndexV1(blockData []byte, footer *Footer) (*Index, error) {
+	blockDataLen := len(blockData)
+	if blockDataLen%4 != 0 || blockDataLen < 8 {
+		return nil, errors.New("Length of block data should be a multiple of 4; file may be corrupted")
+	}
+	idx := new(Index)
+	numBlocks := (blockDataLen-4)/4
+	if footer.Version != 0 && footer.NumBlocks != uint64(numBlocks) {
+		return nil, errors.New("Number of blocks in block data doesn't match footer; file may be corrupted")
+	}
+	idx.BlockSizes = make([]uint64, numBlocks)
+	for i := range idx.BlockSizes {
+		idx.BlockSizes[i] = uint64(bytesToUint32(blockData[i*4:i*4+4]))
+	}
+	idx.LastBlockSize = uint64(bytesToUint32(blockData[blockDataLen-4:]))
+	return idx, nil
+}
@@ -0,0 +1,86 @@
+package format
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// Attributes of the original file
+type Metadata struct {
+	Name string // Original file name
+	ModTime time.Time // Modification time
+	Mode uint32 // Unix mode bits
+	Tags map[string]string // Arbitrary key/value pairs (e.g. source host, backup job ID)
+}
+
+// Error returned when metadata can't be decoded
+var errMetadataTruncated = errors.New("Metadata section is truncated; file may be corrupted")
+
+// Appends a length-prefixed string to data
+func appendMetadataString(data []byte, str string) []byte {
+	return append(append(data, uint32ToBytes(uint32(len(str)))...), str...)
+}
+
+// Reads a length-prefixed string from data. Returns the rest of the data.
+func readMetadataString(data []byte) (string, []byte, error) {
+	if len(data) < 4 {
+		return "", nil, errMetadataTruncated
+	}
+	strLen := uint64(bytesToUint32(data[0:4]))
+	if strLen > uint64(len(data)-4) {
+		return "", nil, errMetadataTruncated
+	}
+	return string(data[4:4+strLen]), data[4+strLen:], nil
+}
+
+// Encodes metadata (little endian):
+// name, int64 mtime seconds, uint32 mtime nanoseconds, uint32 mode, uint32 number of tags, key and value of each tag
+// Strings are stored as a uint32 length followed by the string. Tags are sorted by key.
+func (m *Metadata) Encode() []byte {
+	data := appendMetadataString(nil, m.Name)
+	data = append(data, uint64ToBytes(uint64(m.ModTime.Unix()))...)
+	data = append(data, uint32ToBytes(uint32(m.ModTime.Nanosecond()))...)
+	data = append(data, uint32ToBytes(m.Mode)...)
+	keys := make([]string, 0, len(m.Tags))
+	for key := range m.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	data = append(data, uint32ToBytes(uint32(len(keys)))...)
+	for _, key := range keys {
+		data = appendMetadataString(appendMetadataString(data, key), m.Tags[key])
+	}
+	return data
+}
+
+// Decodes metadata
+func DecodeMetadata(data []byte) (*Metadata, error) {
+	m := new(Metadata)
+	var err error
+	m.Name, data, err = readMetadataString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 20 {
+		return nil, errMetadataTruncated
+	}
+	m.ModTime = time.Unix(int64(bytesToUint64(data[0:8])), int64(bytesToUint32(data[8:12]))).UTC()
+	m.Mode = bytesToUint32(data[12:16])
+	numTags := bytesToUint32(data[16:20])
+	data = data[20:]
+	m.Tags = make(map[string]string)
+	for i := uint32(0); i < numTags; i++ {
+		var key, value string
+		key, data, err = readMetadataString(data)
+		if err != nil {
+			return nil, err
+		}
+		value, data, err = readMetadataString(data)
+		if err != nil {
+			return nil, err
+		}
+		m.Tags[key] = value
+	}
+	return m, nil
+}
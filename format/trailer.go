@@ -0,0 +1,90 @@
+package format
+
+import (
+	"io"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"compress/gzip"
+)
+
+/*** TRAILER ***/
+// The trailer is everything after the compressed blocks: block data gzip files followed by the footer gzip file.
+
+// Writes the trailer for block data. Sets the BlockDataLen of the footer.
+func WriteTrailer(out io.Writer, idx *Index, footer *Footer) error {
+	// Create gzip file containing block data, stored in buffer
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	if _, err := gz.Write(idx.Encode(footer.Version)); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	// Write it in extra data gzips, followed by the footer
+	var err error
+	footer.BlockDataLen, err = Extraify(b.Bytes(), out)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(footer.Encode())
+	return err
+}
+
+// Reads the footer and block data from the end of a file (or sidecar index). Takes 2 reads.
+func ReadTrailer(in io.ReadSeeker, size int64) (*Footer, *Index, error) {
+	// Read the last gzip file in the stream, which contains either the footer or the length of gzipped block data
+	trailerLen := int64(FooterTrailingBytes)
+	if size < trailerLen {
+		trailerLen = size
+	}
+	_, err := in.Seek(size-trailerLen, io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	trailer := make([]byte, trailerLen)
+	_, err = io.ReadFull(in, trailer)
+	if err != nil {
+		return nil, nil, err
+	}
+	footer, err := DecodeFooter(trailer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Get gzipped block data in gzip extra data fields
+	trailingBytes := footer.TrailingBytes()
+	if footer.BlockDataLen > uint64(size-trailingBytes) {
+		return nil, nil, errors.New("Length of block data is larger than file; file may be corrupted")
+	}
+	_, err = in.Seek(size-trailingBytes-int64(footer.BlockDataLen), io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	gzippedBlockData := make([]byte, footer.BlockDataLen)
+	_, err = io.ReadFull(in, gzippedBlockData)
+	if err != nil {
+		return nil, nil, err
+	}
+	gzippedBlockDataRaw, err := Unextraify(gzippedBlockData)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Decompress and decode block data
+	blockDataReader, err := gzip.NewReader(bytes.NewReader(gzippedBlockDataRaw))
+	if err != nil {
+		return nil, nil, err
+	}
+	blockData, err := ioutil.ReadAll(blockDataReader)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx, err := DecodeIndex(blockData, footer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return footer, idx, nil
+}
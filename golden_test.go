@@ -0,0 +1,211 @@
+package press
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/id01/rclone-compression/format"
+)
+
+// Run "go test -run TestGoldenFiles -update" to regenerate the golden files in format/testdata
+var updateGolden = flag.Bool("update", false, "Regenerate golden files")
+
+const goldenDir = "format/testdata"
+const goldenBlockSize = 16384
+const goldenIndexSuffix = ".index"
+
+// Golden files, and how to create them from the golden input. Files in formats of their own (written by standalone
+// codecs) have their block data and footer in a sidecar index, which is a golden file of its own named after the
+// compressed file with goldenIndexSuffix.
+var goldenFiles = []struct {
+	name string
+	create func(t *testing.T, data []byte) []byte
+}{
+	{"gzip-store.press", goldenCompress(GZIP_STORE, nil)},
+	{"gzip-min.press", goldenCompress(GZIP_MIN, nil)},
+	{"gzip-default.press", goldenCompress(GZIP_DEFAULT, nil)},
+	{"gzip-max.press", goldenCompress(GZIP_MAX, nil)},
+	{"xz-min.press", goldenCompress(XZ_IN_GZ_MIN, nil)},
+	{"xz-default.press", goldenCompress(XZ_IN_GZ, nil)},
+	{"lz4.press", goldenCompress(LZ4, nil)},
+	{"snappy.press", goldenCompress(SNAPPY, nil)},
+	{"snappy-raw.press", goldenRawSnappy}, // Raw snappy blocks, as written before the snappy framing format was used
+	{"zstd-default.press", goldenCompress(ZSTD, nil)},
+	{"brotli-default.press", goldenCompress(BROTLI, nil)},
+	{"bzip2.press", goldenCompress(BZIP2, nil)},
+	{"lzma.press", goldenCompress(LZMA, nil)},
+	{"bgzf.bgz", goldenCompress(BGZF, nil)}, // A genuine BGZF file, without block data
+	{"bgzf.bgz" + goldenIndexSuffix, goldenSidecarIndex(BGZF)},
+	{"zstd-seekable.zst", goldenCompress(ZSTD_SEEKABLE, nil)}, // A genuine seekable zstd file, without block data
+	{"zstd-seekable.zst" + goldenIndexSuffix, goldenSidecarIndex(ZSTD_SEEKABLE)},
+	{"xz.xz", goldenCompress(XZ, nil)}, // A genuine multi-block xz file, without block data
+	{"xz.xz" + goldenIndexSuffix, goldenSidecarIndex(XZ)},
+	{"stored.press", goldenCompressWithOptions(GZIP_DEFAULT, func(c *Compression) { c.MaxCompressionRatio = 0 },
+		&CompressOptions{StoreIncompressibleBlocks: true})},
+	{"cdc-hashes-metadata.press", goldenCompressWithOptions(GZIP_MIN, func(c *Compression) {
+		c.SetContentDefinedChunking(2048, 8192, goldenBlockSize)
+		c.Hashes = []HashType{HashMD5, HashSHA256}
+	}, &CompressOptions{Metadata: &Metadata{
+		Name: "input.txt",
+		ModTime: time.Date(2020, 5, 17, 12, 34, 56, 0, time.UTC),
+		Mode: 0100644,
+		Tags: map[string]string{"source": "golden"},
+	}})},
+	{"v1.press", goldenDowngrade(GZIP_DEFAULT, 1)},
+	{"v0.press", goldenDowngrade(GZIP_DEFAULT, 0)},
+}
+
+// Creates a golden file compressed with a mode and golden block size, optionally modifying compression options
+func goldenCompress(mode int, modify func(c *Compression)) func(t *testing.T, data []byte) []byte {
+	return goldenCompressWithOptions(mode, modify, nil)
+}
+
+// Same as goldenCompress, but with per-file options
+func goldenCompressWithOptions(mode int, modify func(c *Compression), opts *CompressOptions) func(t *testing.T, data []byte) []byte {
+	return func(t *testing.T, data []byte) []byte {
+		comp, err := NewCompression(mode, goldenBlockSize)
+		if err == ErrBinaryNotFound {
+			t.Skipf("Can't regenerate golden files: %v", err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if modify != nil {
+			modify(comp)
+		}
+		var compressed bytes.Buffer
+		err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return compressed.Bytes()
+	}
+}
+
+// Creates the sidecar index of a golden file compressed with a mode and golden block size
+func goldenSidecarIndex(mode int) func(t *testing.T, data []byte) []byte {
+	return func(t *testing.T, data []byte) []byte {
+		comp, err := NewCompression(mode, goldenBlockSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var compressed, index bytes.Buffer
+		err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{IndexWriter: &index})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return index.Bytes()
+	}
+}
+
+// Creates a golden snappy file with raw snappy blocks instead of the snappy framing format
+func goldenRawSnappy(t *testing.T, data []byte) []byte {
+	compressed := goldenCompress(SNAPPY, nil)(t, data)
+	footer, idx, err := format.ReadTrailer(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var raw bytes.Buffer
+	blockStart := uint64(0)
+	for i, blockSize := range idx.BlockSizes {
+		var block bytes.Buffer
+		if _, err = decompressBlockSnappy(bytes.NewReader(compressed[blockStart:blockStart+blockSize]), &block); err != nil {
+			t.Fatal(err)
+		}
+		blockStart += blockSize
+		encoded := snappy.Encode(nil, block.Bytes())
+		raw.Write(encoded)
+		idx.BlockSizes[i] = uint64(len(encoded))
+	}
+	if err = format.WriteTrailer(&raw, idx, footer); err != nil {
+		t.Fatal(err)
+	}
+	return raw.Bytes()
+}
+
+// Creates a golden file in an older version of the file format
+func goldenDowngrade(mode int, version uint8) func(t *testing.T, data []byte) []byte {
+	return func(t *testing.T, data []byte) []byte {
+		return downgradeFormat(t, goldenCompress(mode, nil)(t, data), version)
+	}
+}
+
+// Makes sure that the golden files still decompress to the golden input
+func TestGoldenFiles(t *testing.T) {
+	inputPath := filepath.Join(goldenDir, "input.txt")
+	if *updateGolden {
+		err := ioutil.WriteFile(inputPath, makeTestData(40000), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(inputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, golden := range goldenFiles {
+		path := filepath.Join(goldenDir, golden.name)
+		if *updateGolden {
+			err = ioutil.WriteFile(path, golden.create(t, data), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		compressed, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var d io.Reader
+		if strings.HasSuffix(golden.name, goldenIndexSuffix) {
+			// Sidecar indexes are read together with their compressed file
+			index := compressed
+			compressed, err = ioutil.ReadFile(strings.TrimSuffix(path, goldenIndexSuffix))
+			if err != nil {
+				t.Fatal(err)
+			}
+			comp, err := NewCompressionPreset("gzip-default")
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, _, err = comp.DecompressFileWithIndex(bytes.NewReader(compressed), bytes.NewReader(index), int64(len(index)))
+			if err != nil {
+				t.Fatalf("%s: %v", golden.name, err)
+			}
+		} else {
+			d, err = Open(bytes.NewReader(compressed), int64(len(compressed)))
+			if err != nil {
+				t.Fatalf("%s: %v", golden.name, err)
+			}
+		}
+		decompressed, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatalf("%s: %v", golden.name, err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("%s: Decompressed data doesn't match golden input", golden.name)
+		}
+	}
+
+	// Hashes and metadata should be readable from the golden file that has them
+	compressed, err := ioutil.ReadFile(filepath.Join(goldenDir, "cdc-hashes-metadata.press"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = d.Hash(HashSHA256); err != nil {
+		t.Fatal(err)
+	}
+	if d.Metadata() == nil || d.Metadata().Name != "input.txt" {
+		t.Fatalf("Metadata is %+v, expected name input.txt", d.Metadata())
+	}
+}
@@ -0,0 +1,364 @@
+package press
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+/*** XXH32 ***/
+// xxHash (32-bit), used for the checksums in LZ4 frames
+const (
+	xxh32Prime1 uint32 = 2654435761
+	xxh32Prime2 uint32 = 2246822519
+	xxh32Prime3 uint32 = 3266489917
+	xxh32Prime4 uint32 = 668265263
+	xxh32Prime5 uint32 = 374761393
+)
+
+// Mixes 4 bytes of input into an accumulator
+func xxh32Round(acc uint32, input uint32) uint32 {
+	acc += input * xxh32Prime2
+	acc = bits.RotateLeft32(acc, 13)
+	return acc * xxh32Prime1
+}
+
+// Computes the xxHash32 of data
+func xxh32(data []byte, seed uint32) uint32 {
+	n := len(data)
+	var h uint32
+	if n >= 16 {
+		v1 := seed + xxh32Prime1 + xxh32Prime2
+		v2 := seed + xxh32Prime2
+		v3 := seed
+		v4 := seed - xxh32Prime1
+		for ; len(data) >= 16; data = data[16:] {
+			v1 = xxh32Round(v1, binary.LittleEndian.Uint32(data[0:4]))
+			v2 = xxh32Round(v2, binary.LittleEndian.Uint32(data[4:8]))
+			v3 = xxh32Round(v3, binary.LittleEndian.Uint32(data[8:12]))
+			v4 = xxh32Round(v4, binary.LittleEndian.Uint32(data[12:16]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxh32Prime5
+	}
+	h += uint32(n)
+
+	// Mix in the remaining bytes
+	for ; len(data) >= 4; data = data[4:] {
+		h += binary.LittleEndian.Uint32(data[0:4]) * xxh32Prime3
+		h = bits.RotateLeft32(h, 17) * xxh32Prime4
+	}
+	for _, b := range data {
+		h += uint32(b) * xxh32Prime5
+		h = bits.RotateLeft32(h, 11) * xxh32Prime1
+	}
+
+	// Avalanche
+	h ^= h >> 15
+	h *= xxh32Prime2
+	h ^= h >> 13
+	h *= xxh32Prime3
+	h ^= h >> 16
+	return h
+}
+
+/*** LZ4 FRAMES ***/
+// See https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md and lz4_Block_format.md.
+// Frames are written like the lz4 binary does by default: independent 64KB blocks followed by a content checksum.
+const lz4FrameMagicNumber = 0x184d2204
+const lz4SkippableMagicMask = 0xfffffff0
+const lz4SkippableMagicNumber = 0x184d2a50
+
+// Frame descriptor flags
+const (
+	lz4FlagVersion = 0x40 // Version number (01) in the two high bits
+	lz4FlagBlockIndependence = 0x20
+	lz4FlagBlockChecksum = 0x10
+	lz4FlagContentSize = 0x08
+	lz4FlagContentChecksum = 0x04
+	lz4FlagDictID = 0x01
+)
+const lz4BlockMaxSizeID = 4 // Maximum block size ID we write (64KB)
+const lz4BlockUncompressed = 0x80000000 // High bit of block size, set if the block is stored uncompressed
+
+// LZ4 block format constants
+const lz4MinMatch = 4 // Minimum length of a match
+const lz4LastLiterals = 5 // The last 5 bytes of a block are always literals
+const lz4MFLimit = 12 // The last match must start at least 12 bytes before the end of the block
+const lz4MaxOffset = 65535 // Maximum distance of a match
+const lz4HashLog = 16 // Size of the hash table used to find matches
+
+// Gets the maximum uncompressed size of a block from the block maximum size ID in a frame descriptor
+func lz4BlockMaxSize(id uint8) int {
+	return 1 << (8 + 2*uint(id))
+}
+
+// Appends a literal or match length that doesn't fit in a token
+func lz4AppendLength(out []byte, length int) []byte {
+	for ; length >= 255; length -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(length))
+}
+
+// Appends a sequence (literals followed by a match) to a compressed block.
+// A match length of 0 means that there is no match (this is the last sequence of the block).
+func lz4AppendSequence(out []byte, literals []byte, offset int, matchLen int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 0xf0
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	if matchLen != 0 {
+		if matchLen-lz4MinMatch >= 15 {
+			token |= 0x0f
+		} else {
+			token |= byte(matchLen - lz4MinMatch)
+		}
+	}
+	out = append(out, token)
+	if len(literals) >= 15 {
+		out = lz4AppendLength(out, len(literals)-15)
+	}
+	out = append(out, literals...)
+	if matchLen != 0 {
+		out = append(out, byte(offset), byte(offset>>8))
+		if matchLen-lz4MinMatch >= 15 {
+			out = lz4AppendLength(out, matchLen-lz4MinMatch-15)
+		}
+	}
+	return out
+}
+
+// Hashes the 4 bytes at the start of data
+func lz4Hash(data []byte) uint32 {
+	return (binary.LittleEndian.Uint32(data[0:4]) * xxh32Prime1) >> (32 - lz4HashLog)
+}
+
+// Compresses a block using the LZ4 block format, appending it to out. Uses a greedy hash table match finder.
+func lz4CompressBlock(in []byte, out []byte) []byte {
+	var table [1 << lz4HashLog]int32 // Position+1 of the last occurrence of each hash (0 means none)
+	anchor := 0 // Start of literals that haven't been written yet
+	if len(in) >= lz4MFLimit+1 {
+		matchLimit := len(in) - lz4LastLiterals // Matches can't extend past this
+		for pos := 0; pos < len(in)-lz4MFLimit; {
+			h := lz4Hash(in[pos:])
+			candidate := int(table[h]) - 1
+			table[h] = int32(pos + 1)
+			if candidate < 0 || pos-candidate > lz4MaxOffset || !bytes.Equal(in[candidate:candidate+4], in[pos:pos+4]) {
+				pos++
+				continue
+			}
+
+			// Extend match backwards over literals, then forwards
+			for pos > anchor && candidate > 0 && in[pos-1] == in[candidate-1] {
+				pos--
+				candidate--
+			}
+			matchLen := lz4MinMatch
+			for pos+matchLen < matchLimit && in[pos+matchLen] == in[candidate+matchLen] {
+				matchLen++
+			}
+			out = lz4AppendSequence(out, in[anchor:pos], pos-candidate, matchLen)
+			pos += matchLen
+			anchor = pos
+		}
+	}
+	return lz4AppendSequence(out, in[anchor:], 0, 0)
+}
+
+// Decompresses a block in the LZ4 block format, appending it to out. Matches can refer to anything already in out.
+func lz4DecompressBlock(in []byte, out []byte, maxSize int) ([]byte, error) {
+	errCorrupt := errors.New("LZ4 block is corrupted")
+	outStart := len(out)
+	for pos := 0; pos < len(in); {
+		// Get literal length
+		token := in[pos]
+		pos++
+		literalLen := int(token >> 4)
+		if literalLen == 15 {
+			for {
+				if pos >= len(in) {
+					return nil, errCorrupt
+				}
+				literalLen += int(in[pos])
+				pos++
+				if in[pos-1] != 255 {
+					break
+				}
+			}
+		}
+
+		// Copy literals
+		if literalLen > len(in)-pos || len(out)-outStart+literalLen > maxSize {
+			return nil, errCorrupt
+		}
+		out = append(out, in[pos:pos+literalLen]...)
+		pos += literalLen
+		if pos == len(in) { // The last sequence has no match
+			break
+		}
+
+		// Get match offset and length
+		if pos+2 > len(in) {
+			return nil, errCorrupt
+		}
+		offset := int(in[pos]) | int(in[pos+1])<<8
+		pos += 2
+		matchLen := int(token & 0x0f)
+		if matchLen == 15 {
+			for {
+				if pos >= len(in) {
+					return nil, errCorrupt
+				}
+				matchLen += int(in[pos])
+				pos++
+				if in[pos-1] != 255 {
+					break
+				}
+			}
+		}
+		matchLen += lz4MinMatch
+
+		// Copy match (byte by byte, since the match may overlap with itself)
+		if offset == 0 || offset > len(out) || len(out)-outStart+matchLen > maxSize {
+			return nil, errCorrupt
+		}
+		matchStart := len(out) - offset
+		for i := 0; i < matchLen; i++ {
+			out = append(out, out[matchStart+i])
+		}
+	}
+	return out, nil
+}
+
+// Compresses data into a single LZ4 frame
+func lz4CompressFrame(in []byte) []byte {
+	// Write frame header
+	out := make([]byte, 0, len(in)+len(in)/255+64)
+	out = binary.LittleEndian.AppendUint32(out, lz4FrameMagicNumber)
+	descriptor := []byte{lz4FlagVersion | lz4FlagBlockIndependence | lz4FlagContentChecksum, lz4BlockMaxSizeID << 4}
+	out = append(out, descriptor...)
+	out = append(out, byte(xxh32(descriptor, 0)>>8))
+
+	// Write blocks, storing them uncompressed if they don't compress
+	blockMaxSize := lz4BlockMaxSize(lz4BlockMaxSizeID)
+	for start := 0; start < len(in); start += blockMaxSize {
+		end := start + blockMaxSize
+		if end > len(in) {
+			end = len(in)
+		}
+		sizePos := len(out)
+		out = append(out, 0, 0, 0, 0)
+		out = lz4CompressBlock(in[start:end], out)
+		blockSize := uint32(len(out) - sizePos - 4)
+		if blockSize >= uint32(end-start) {
+			out = append(out[:sizePos+4], in[start:end]...)
+			blockSize = uint32(end-start) | lz4BlockUncompressed
+		}
+		binary.LittleEndian.PutUint32(out[sizePos:], blockSize)
+	}
+
+	// Write end mark and content checksum
+	out = append(out, 0, 0, 0, 0)
+	return binary.LittleEndian.AppendUint32(out, xxh32(in, 0))
+}
+
+// Decompresses a stream of LZ4 frames (skipping skippable frames). maxSize is a hint for the decompressed size.
+func lz4DecompressFrames(in []byte, maxSize int64) ([]byte, error) {
+	errTruncated := errors.New("LZ4 frame is truncated")
+	out := make([]byte, 0, maxSize)
+	for len(in) > 0 {
+		if len(in) < 4 {
+			return nil, errTruncated
+		}
+		magic := binary.LittleEndian.Uint32(in[0:4])
+
+		// Skip skippable frames
+		if magic&lz4SkippableMagicMask == lz4SkippableMagicNumber {
+			if len(in) < 8 || uint64(len(in)-8) < uint64(binary.LittleEndian.Uint32(in[4:8])) {
+				return nil, errTruncated
+			}
+			in = in[8+binary.LittleEndian.Uint32(in[4:8]):]
+			continue
+		}
+		if magic != lz4FrameMagicNumber {
+			return nil, errors.New("Not an LZ4 frame")
+		}
+
+		// Read frame descriptor
+		if len(in) < 7 {
+			return nil, errTruncated
+		}
+		flags, bd := in[4], in[5]
+		if flags&0xc0 != lz4FlagVersion {
+			return nil, errors.New("Unsupported LZ4 frame version")
+		}
+		if flags&lz4FlagDictID != 0 {
+			return nil, errors.New("LZ4 frames with dictionaries are not supported")
+		}
+		descriptorLen := 2
+		if flags&lz4FlagContentSize != 0 {
+			descriptorLen += 8
+		}
+		if len(in) < 4+descriptorLen+1 {
+			return nil, errTruncated
+		}
+		if byte(xxh32(in[4:4+descriptorLen], 0)>>8) != in[4+descriptorLen] {
+			return nil, errors.New("LZ4 frame descriptor checksum doesn't match")
+		}
+		blockMaxSize := lz4BlockMaxSize((bd >> 4) & 0x07)
+		in = in[4+descriptorLen+1:]
+
+		// Read blocks. Dependent blocks work too, since every block is decompressed after the previous ones.
+		frameStart := len(out)
+		for {
+			if len(in) < 4 {
+				return nil, errTruncated
+			}
+			blockSize := binary.LittleEndian.Uint32(in[0:4])
+			in = in[4:]
+			if blockSize == 0 { // End mark
+				break
+			}
+			uncompressed := blockSize&lz4BlockUncompressed != 0
+			blockSize &^= lz4BlockUncompressed
+			blockEnd := uint64(blockSize)
+			if flags&lz4FlagBlockChecksum != 0 {
+				blockEnd += 4
+			}
+			if uint64(len(in)) < blockEnd || int(blockSize) > blockMaxSize {
+				return nil, errTruncated
+			}
+			block := in[:blockSize]
+			if flags&lz4FlagBlockChecksum != 0 && xxh32(block, 0) != binary.LittleEndian.Uint32(in[blockSize:blockSize+4]) {
+				return nil, errors.New("LZ4 block checksum doesn't match")
+			}
+			if uncompressed {
+				out = append(out, block...)
+			} else {
+				var err error
+				out, err = lz4DecompressBlock(block, out, blockMaxSize)
+				if err != nil {
+					return nil, err
+				}
+			}
+			in = in[blockEnd:]
+		}
+
+		// Check content checksum
+		if flags&lz4FlagContentChecksum != 0 {
+			if len(in) < 4 {
+				return nil, errTruncated
+			}
+			if xxh32(out[frameStart:], 0) != binary.LittleEndian.Uint32(in[0:4]) {
+				return nil, errors.New("LZ4 content checksum doesn't match")
+			}
+			in = in[4:]
+		}
+	}
+	return out, nil
+}
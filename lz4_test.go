@@ -0,0 +1,96 @@
+package press
+
+import (
+	"bytes"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestXxh32(t *testing.T) {
+	for _, vector := range []struct {
+		data string
+		hash uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	} {
+		if hash := xxh32([]byte(vector.data), 0); hash != vector.hash {
+			t.Fatalf("xxh32(%q) is %08x, expected %08x", vector.data, hash, vector.hash)
+		}
+	}
+}
+
+// Inputs that exercise the edges of the LZ4 block format
+func lz4TestInputs() [][]byte {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+	return [][]byte{
+		{},
+		[]byte("a"),
+		[]byte("abcdabcdabcd"), // Too short for a match
+		bytes.Repeat([]byte("a"), 1000), // Overlapping matches
+		bytes.Repeat([]byte("0123456789"), 30000), // Long matches across frame blocks
+		random, // Incompressible, so blocks are stored
+		makeTestData(300000),
+	}
+}
+
+func TestLz4RoundTrip(t *testing.T) {
+	for _, data := range lz4TestInputs() {
+		compressed := lz4CompressFrame(data)
+		decompressed, err := lz4DecompressFrames(compressed, int64(len(data)))
+		if err != nil {
+			t.Fatalf("Length %d: %v", len(data), err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("Length %d: Decompressed data doesn't match original data", len(data))
+		}
+
+		// Corruption should be caught by the content checksum
+		if len(data) > 0 {
+			compressed[len(compressed)-5] ^= 0xff
+			if _, err = lz4DecompressFrames(compressed, int64(len(data))); err == nil {
+				t.Fatalf("Length %d: Corrupted frame wasn't rejected", len(data))
+			}
+		}
+	}
+}
+
+func TestLz4Binary(t *testing.T) {
+	binPath, err := exec.LookPath("lz4")
+	if err != nil {
+		t.Skip("lz4 binary not found")
+	}
+	for _, data := range lz4TestInputs() {
+		// Our frames should decompress with the lz4 binary
+		cmd := exec.Command(binPath, "-dc")
+		cmd.Stdin = bytes.NewReader(lz4CompressFrame(data))
+		decompressed, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("Length %d: %v", len(data), err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatalf("Length %d: Data decompressed by lz4 binary doesn't match original data", len(data))
+		}
+
+		// Frames from the lz4 binary (including ones with dependent blocks and block checksums) should decompress
+		for _, args := range [][]string{{"-c"}, {"-c", "-9", "--content-size"}, {"-c", "-BD", "-BX", "-B4"}} {
+			cmd = exec.Command(binPath, args...)
+			cmd.Stdin = bytes.NewReader(data)
+			compressed, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			decompressed, err = lz4DecompressFrames(compressed, int64(len(data)))
+			if err != nil {
+				t.Fatalf("Length %d, %v: %v", len(data), args, err)
+			}
+			if !bytes.Equal(decompressed, data) {
+				t.Fatalf("Length %d, %v: Decompressed data doesn't match original data", len(data), args)
+			}
+		}
+	}
+}
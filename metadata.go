@@ -0,0 +1,13 @@
+package press
+
+import (
+	"github.com/id01/rclone-compression/format"
+)
+
+// Attributes of the original file, stored in the block data of compressed files (see CompressOptions.Metadata)
+type Metadata = format.Metadata
+
+// Gets the metadata stored in the file, without decompressing anything. Returns nil if the file has no metadata.
+func (d Decompressor) Metadata() *Metadata {
+	return d.metadata
+}
@@ -0,0 +1,44 @@
+package press
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	comp, err := NewCompressionPreset("gzip-min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata := &Metadata{
+		Name: "test.vdi",
+		ModTime: time.Date(2020, 5, 17, 12, 34, 56, 789, time.UTC),
+		Mode: 0100644,
+		Tags: map[string]string{"host": "backup01", "job": "12345"},
+	}
+	data := makeTestData(100000)
+	var compressed bytes.Buffer
+	err = comp.CompressFileWithOptions(bytes.NewReader(data), int64(len(data)), &compressed, &CompressOptions{Metadata: metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.Metadata(), metadata) {
+		t.Fatalf("Metadata is %+v, expected %+v", d.Metadata(), metadata)
+	}
+
+	// Files compressed without metadata shouldn't have any
+	compressed2 := compressTestData(t, "gzip-min", data)
+	d, err = Open(bytes.NewReader(compressed2), int64(len(compressed2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Metadata() != nil {
+		t.Fatal("File compressed without metadata has metadata")
+	}
+}
@@ -0,0 +1,202 @@
+package press
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os/exec"
+	"sync"
+)
+
+/*** FRAMED PROTOCOL ***/
+// Long-lived worker processes get one block per request on stdin, and answer each request on stdout:
+// * request: uint32 length of block, block
+// * response: uint8 status, uint32 length of data, data. The data is the processed block if the status is 0 (frameStatusOK),
+//   or an error message otherwise.
+// All lengths are little endian. A worker should exit when its stdin is closed.
+const frameStatusOK = 0
+
+// Writes a request frame
+func writeFrame(out io.Writer, data []byte) error {
+	_, err := out.Write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...))
+	return err
+}
+
+// Reads a request frame
+func readFrame(in io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	_, err := io.ReadFull(in, header)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header))
+	_, err = io.ReadFull(in, data)
+	return data, err
+}
+
+// Writes a response frame
+func writeResponseFrame(out io.Writer, status uint8, data []byte) error {
+	_, err := out.Write([]byte{status})
+	if err != nil {
+		return err
+	}
+	return writeFrame(out, data)
+}
+
+// Error reported by a worker process for a block
+type WorkerError struct {
+	Message string
+}
+
+func (e *WorkerError) Error() string {
+	return "Worker process error: " + e.Message
+}
+
+// Reads a response frame. Returns a WorkerError if the worker reported an error.
+func readResponseFrame(in io.Reader) ([]byte, error) {
+	status := make([]byte, 1)
+	_, err := io.ReadFull(in, status)
+	if err != nil {
+		return nil, err
+	}
+	data, err := readFrame(in)
+	if err != nil {
+		return nil, err
+	}
+	if status[0] != frameStatusOK {
+		return nil, &WorkerError{string(data)}
+	}
+	return data, nil
+}
+
+/*** WORKER POOL ***/
+// A worker process speaking the framed protocol
+type worker struct {
+	cmd *exec.Cmd
+	stdin io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// Shuts down a worker by closing its stdin and waiting for it to exit
+func (w *worker) close() error {
+	w.stdin.Close()
+	return w.cmd.Wait()
+}
+
+// Pool of worker processes running the same command. Workers are started when needed, and are kept around
+// after processing a block so that they can be reused for later blocks (and files).
+type workerPool struct {
+	path string // Path of worker binary
+	args []string // Arguments of worker binary
+	lock sync.Mutex
+	idle []*worker // Workers that aren't processing a block
+	closed bool // Whether the pool has been closed
+}
+
+// Called whenever a worker process is started, if not nil (so that tests can count them)
+var workerStartHook func(p *workerPool)
+
+// Creates a worker pool for a command
+func newWorkerPool(path string, args []string) *workerPool {
+	return &workerPool{path: path, args: args}
+}
+
+// Starts a worker process
+func (p *workerPool) startWorker() (*worker, error) {
+	w := &worker{cmd: exec.Command(p.path, p.args...)}
+	var err error
+	w.stdin, err = w.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := w.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	w.stdout = bufio.NewReader(stdout)
+	err = w.cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	if workerStartHook != nil {
+		workerStartHook(p)
+	}
+	return w, nil
+}
+
+// Gets an idle worker, or starts a new one if there are none
+func (p *workerPool) get() (*worker, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.closed {
+		return nil, errors.New("Worker pool is closed")
+	}
+	if len(p.idle) > 0 {
+		w := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		return w, nil
+	}
+	return p.startWorker()
+}
+
+// Returns a worker to the pool, or shuts it down if the pool has been closed
+func (p *workerPool) put(w *worker) {
+	p.lock.Lock()
+	if !p.closed {
+		p.idle = append(p.idle, w)
+		p.lock.Unlock()
+		return
+	}
+	p.lock.Unlock()
+	w.close()
+}
+
+// Processes a block with a worker
+func (p *workerPool) process(in []byte) ([]byte, error) {
+	w, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	// Send the block while reading the response, so that neither side blocks on a full pipe
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writeFrame(w.stdin, in)
+	}()
+	out, err := readResponseFrame(w.stdout)
+	if _, ok := err.(*WorkerError); err != nil && !ok {
+		// If we couldn't communicate with the worker, it's in an unknown state, so get rid of it.
+		// Killing it also unblocks the write if it's still going.
+		w.cmd.Process.Kill()
+		<-writeErr
+		w.close()
+		return nil, err
+	}
+
+	// The worker reads the whole block before answering, so the write has finished too.
+	// It's fine to reuse the worker if it reported an error.
+	if werr := <-writeErr; werr != nil {
+		w.cmd.Process.Kill()
+		w.close()
+		return nil, werr
+	}
+	p.put(w)
+	return out, err
+}
+
+// Shuts down all idle workers. Busy workers are shut down when they finish their block.
+func (p *workerPool) Close() error {
+	p.lock.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+	var firstErr error
+	for _, w := range idle {
+		if err := w.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,158 @@
+package press
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// Not a real test. Runs as a framed worker process for the tests below, gzipping or gunzipping blocks.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	mode := os.Args[len(os.Args)-1]
+	in := bufio.NewReader(os.Stdin)
+	out := bufio.NewWriter(os.Stdout)
+	for {
+		block, err := readFrame(in)
+		if err == io.EOF {
+			os.Exit(0)
+		} else if err != nil {
+			os.Exit(1)
+		}
+
+		var b bytes.Buffer
+		if mode == "compress" {
+			gz := gzip.NewWriter(&b)
+			gz.Write(block)
+			err = gz.Close()
+		} else {
+			var gz *gzip.Reader
+			gz, err = gzip.NewReader(bytes.NewReader(block))
+			if err == nil {
+				_, err = io.Copy(&b, gz)
+			}
+		}
+		if err != nil {
+			writeResponseFrame(out, 1, []byte(err.Error()))
+		} else {
+			writeResponseFrame(out, frameStatusOK, b.Bytes())
+		}
+		out.Flush()
+	}
+}
+
+// Creates a framed codec running the helper process
+func newHelperCodec(t *testing.T) *ExternalCodec {
+	t.Setenv("GO_WANT_HELPER_PROCESS", "1")
+	helper := []string{os.Args[0], "-test.run=TestHelperProcess", "--"}
+	codec, err := NewFramedExternalCodec(202, "gzip-helper", ".gzhelper", append(helper, "compress"), append(helper, "decompress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+// Counts the workers started by each worker pool
+type workerStartCounter struct {
+	lock sync.Mutex
+	started map[*workerPool]int
+}
+
+// Starts counting the workers started during a test
+func countWorkerStarts(t *testing.T) *workerStartCounter {
+	counter := &workerStartCounter{started: make(map[*workerPool]int)}
+	workerStartHook = func(p *workerPool) {
+		counter.lock.Lock()
+		counter.started[p]++
+		counter.lock.Unlock()
+	}
+	t.Cleanup(func() {
+		workerStartHook = nil
+	})
+	return counter
+}
+
+// Gets the number of workers a pool has started
+func (c *workerStartCounter) get(p *workerPool) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.started[p]
+}
+
+func TestFramedExternalCodec(t *testing.T) {
+	counter := countWorkerStarts(t)
+	codec := newHelperCodec(t)
+	const framedMode = 1002
+	if err := RegisterCodec(framedMode, codec); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		unregisterCodec(framedMode)
+	})
+	comp, err := NewCompression(framedMode, 65536)
+	if err != nil {
+		t.Fatal(err)
+	}
+	comp.NumThreads = 4
+
+	// Compress several files. Workers should be reused across blocks and files.
+	data := makeTestData(1000000)
+	var compressStarted, decompressStarted int
+	for i := 0; i < 3; i++ {
+		var compressed bytes.Buffer
+		err = comp.CompressFile(bytes.NewReader(data), int64(len(data)), &compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decompressed, err := ioutil.ReadAll(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatal("Decompressed data doesn't match original data")
+		}
+		if i == 0 {
+			compressStarted, decompressStarted = counter.get(codec.compressPool), counter.get(codec.decompressPool)
+		} else if counter.get(codec.compressPool) != compressStarted || counter.get(codec.decompressPool) != decompressStarted {
+			t.Fatal("Workers weren't reused across files")
+		}
+	}
+	if started := counter.get(codec.compressPool); started > comp.NumThreads {
+		t.Fatalf("Started %d compression workers for %d threads", started, comp.NumThreads)
+	}
+
+	// Errors reported by workers should be returned, and the worker should stay usable
+	_, err = codec.decompressPool.process([]byte("not gzip"))
+	if _, ok := err.(*WorkerError); !ok {
+		t.Fatalf("Expected WorkerError, got %v", err)
+	}
+	started := counter.get(codec.decompressPool)
+	if _, err = codec.decompressPool.process(nil); err == nil {
+		t.Fatal("Expected an error for an empty block")
+	}
+	if counter.get(codec.decompressPool) != started {
+		t.Fatal("Worker wasn't reused after reporting an error")
+	}
+
+	// Closing should shut down all workers
+	if err = codec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(codec.compressPool.idle) != 0 || len(codec.decompressPool.idle) != 0 {
+		t.Fatal("Workers are still running after closing")
+	}
+	if _, err = codec.compressPool.process(data[:100]); err == nil {
+		t.Fatal("Using a closed codec should fail")
+	}
+}
@@ -0,0 +1,338 @@
+package press
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+/*** XZ FORMAT ***/
+// See https://tukaani.org/xz/xz-file-format.txt. An xz file is a stream of:
+// * a stream header: magic bytes, 2 bytes of stream flags (the type of check of blocks), CRC32 of the stream flags
+// * blocks, each of which is a block header, LZMA2 data, padding to a multiple of 4 bytes, and a check of the uncompressed data
+// * an index with the unpadded size (size without padding) and uncompressed size of every block
+// * a stream footer: CRC32, size of the index, stream flags, "YZ"
+// Sizes in the index and in block headers are variable length integers. Files compressed in XZ mode are genuine
+// multi-block xz files, so block data and footer are only written to a sidecar index. The stream header is part of
+// the first block. Since the unpadded size of a block can't be told from its size, it is found by walking its LZMA2 chunks.
+const xzStreamHeaderSize = 12
+const xzStreamFooterSize = 12
+const xzCheckType = xz.CRC64 // Check of blocks we write (like the xz binary)
+const xzLzma2FilterID = 0x21
+var xzFooterMagic = []byte{'Y', 'Z'}
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// Block header flags
+const xzBlockCompressedSizeFlag = 0x40
+const xzBlockUncompressedSizeFlag = 0x80
+
+// Appends a variable length integer
+func appendXzVarint(b []byte, n uint64) []byte {
+	for n >= 0x80 {
+		b = append(b, byte(n)|0x80)
+		n >>= 7
+	}
+	return append(b, byte(n))
+}
+
+// Reads a variable length integer, returning it and its length
+func readXzVarint(b []byte) (n uint64, length int, err error) {
+	for length < len(b) && length < 9 {
+		n |= uint64(b[length]&0x7f) << (7 * uint(length))
+		length++
+		if b[length-1]&0x80 == 0 {
+			if b[length-1] == 0 && length > 1 {
+				return 0, 0, errors.New("xz integer isn't in its shortest form")
+			}
+			return n, length, nil
+		}
+	}
+	return 0, 0, errors.New("Invalid xz integer")
+}
+
+// Pads to a multiple of 4 bytes
+func xzPad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Returns the stream header for a type of check
+func xzStreamHeader(checkType byte) []byte {
+	header := append(append([]byte{}, xzMagic...), 0, checkType)
+	return binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(header[6:8]))
+}
+
+// Returns the index and stream footer of blocks with the given unpadded and uncompressed sizes
+func xzIndexAndFooter(unpaddedSizes []uint64, uncompressedSizes []uint64, checkType byte) []byte {
+	index := appendXzVarint([]byte{0}, uint64(len(unpaddedSizes)))
+	for i, unpaddedSize := range unpaddedSizes {
+		index = appendXzVarint(index, unpaddedSize)
+		index = appendXzVarint(index, uncompressedSizes[i])
+	}
+	index = xzPad(index)
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+	footer := append(binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1)), 0, checkType)
+	footer = append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(footer)), footer...)
+	return append(append(index, footer...), xzFooterMagic...)
+}
+
+// Function that compresses a block into an xz block in pure Go (without stream header)
+func (c *Compression) compressBlockXz(in []byte, out io.Writer) (compressedSize uint64, uncompressedSize int64, err error) {
+	// The dictionary never needs to be larger than a block
+	dictCap := int(c.BlockSize)
+	if dictCap < lzma.MinDictCap {
+		dictCap = lzma.MinDictCap
+	}
+
+	// Compress to LZMA2
+	var lzma2 bytes.Buffer
+	lzma2Writer, err := lzma.Writer2Config{DictCap: dictCap, Matcher: lzma.HashTable4}.NewWriter2(&lzma2)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = lzma2Writer.Write(in)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = lzma2Writer.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Write block header with both sizes (like the multithreaded xz binary), then LZMA2 data, padding and check
+	header := []byte{0, xzBlockCompressedSizeFlag | xzBlockUncompressedSizeFlag}
+	header = appendXzVarint(header, uint64(lzma2.Len()))
+	header = appendXzVarint(header, uint64(len(in)))
+	header = append(header, xzLzma2FilterID, 1, lzma.EncodeDictCap(int64(dictCap)))
+	header = xzPad(header)
+	header[0] = byte(len(header)/4)
+	header = binary.LittleEndian.AppendUint32(header, crc32.ChecksumIEEE(header))
+	block := append(header, lzma2.Bytes()...)
+	block = xzPad(block)
+	block = binary.LittleEndian.AppendUint64(block, crc64.Checksum(in, crc64Table))
+	n, err := out.Write(block)
+	return uint64(n), int64(len(in)), err
+}
+
+// Finds the sizes of an xz block by walking its LZMA2 chunks. The block may start with the stream header.
+// Returns the type of check of the block (told from the size of the check), and its unpadded and uncompressed sizes.
+func xzBlockSizes(block []byte) (checkType byte, unpaddedSize uint64, uncompressedSize uint64, err error) {
+	if bytes.HasPrefix(block, xzMagic) {
+		if len(block) < xzStreamHeaderSize {
+			return 0, 0, 0, errors.New("xz stream header is truncated")
+		}
+		block = block[xzStreamHeaderSize:]
+	}
+	if len(block) == 0 || block[0] == 0 {
+		return 0, 0, 0, errors.New("Not an xz block")
+	}
+
+	// Walk LZMA2 chunks until the end marker
+	pos := (int(block[0]) + 1) * 4
+	for {
+		if pos >= len(block) {
+			return 0, 0, 0, errors.New("xz block is truncated")
+		}
+		control := block[pos]
+		if control == 0 { // End of LZMA2 data
+			pos++
+			break
+		}
+		if pos+3 > len(block) {
+			return 0, 0, 0, errors.New("xz block is truncated")
+		}
+		chunkSize := int(block[pos+1])<<8 | int(block[pos+2]) + 1
+		if control == 1 || control == 2 { // Uncompressed chunk
+			uncompressedSize += uint64(chunkSize)
+			pos += 3 + chunkSize
+		} else if control >= 0x80 { // LZMA chunk, with new properties if it resets them
+			if pos+5 > len(block) {
+				return 0, 0, 0, errors.New("xz block is truncated")
+			}
+			uncompressedSize += uint64(int(control&0x1f)<<16 + chunkSize)
+			headerSize := 5
+			if control >= 0xc0 {
+				headerSize = 6
+			}
+			pos += headerSize + (int(block[pos+3])<<8 | int(block[pos+4]) + 1)
+		} else {
+			return 0, 0, 0, errors.New("Invalid LZMA2 chunk in xz block")
+		}
+	}
+
+	// What's left is padding and the check. Padding is at most 3 bytes and checks are multiples of 4 bytes, so the size of the check is known.
+	checkSize := len(block) - (pos+3)/4*4
+	switch checkSize {
+	case 0:
+		checkType = xz.None
+	case 4:
+		checkType = xz.CRC32
+	case 8:
+		checkType = xz.CRC64
+	case 32:
+		checkType = xz.SHA256
+	default:
+		return 0, 0, 0, errors.New("xz block has an invalid size or an unsupported check")
+	}
+	return checkType, uint64(pos + checkSize), uncompressedSize, nil
+}
+
+// Utility function to decompress an xz block (which may start with the stream header). The block is put in a stream
+// of its own, which is decompressed in pure Go, or with the xz binary if preferred or if pure Go can't read it.
+func decompressBlockXz(in io.Reader, out io.Writer, binaryPath string, preferBinary bool) (n int, err error) {
+	var block bytes.Buffer
+	_, err = io.Copy(&block, in)
+	if err != nil {
+		return 0, err
+	}
+	checkType, unpaddedSize, uncompressedSize, err := xzBlockSizes(block.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	blockBytes := block.Bytes()
+	if bytes.HasPrefix(blockBytes, xzMagic) {
+		blockBytes = blockBytes[xzStreamHeaderSize:]
+	}
+	stream := xzStreamHeader(checkType)
+	stream = append(stream, blockBytes...)
+	stream = append(stream, xzIndexAndFooter([]uint64{unpaddedSize}, []uint64{uncompressedSize}, checkType)...)
+
+	// Decompress stream
+	if preferBinary && binaryPath != "" {
+		return decompressBlockRangeExecNogz(bytes.NewReader(stream), out, binaryPath, []string{"-dc"})
+	}
+	var decompressed bytes.Buffer
+	xzReader, err := xz.NewReader(bytes.NewReader(stream))
+	if err == nil {
+		_, err = io.Copy(&decompressed, xzReader)
+	}
+	if err != nil {
+		if binaryPath == "" {
+			return 0, err
+		}
+		return decompressBlockRangeExecNogz(bytes.NewReader(stream), out, binaryPath, []string{"-dc"})
+	}
+	n64, err := io.Copy(out, &decompressed)
+	return int(n64), err
+}
+
+// Whether a file is an xz file (starts with the xz magic bytes and ends with a stream footer)
+func hasXzFooter(in io.ReadSeeker, size int64) bool {
+	if size < xzStreamHeaderSize+xzStreamFooterSize {
+		return false
+	}
+	magic := make([]byte, len(xzMagic))
+	in.Seek(0, io.SeekStart)
+	if _, err := io.ReadFull(in, magic); err != nil || !bytes.Equal(magic, xzMagic) {
+		return false
+	}
+	in.Seek(size-int64(len(xzFooterMagic)), io.SeekStart)
+	_, err := io.ReadFull(in, magic[:len(xzFooterMagic)])
+	return err == nil && bytes.Equal(magic[:len(xzFooterMagic)], xzFooterMagic)
+}
+
+// Reads the stream header, stream footer and index of a single-stream xz file. Returns the compressed and uncompressed
+// start of each block (ending with the end of the last block). The first block starts at 0, so it includes the stream header.
+func readXzIndex(in io.ReadSeeker, size int64) (blockStarts []int64, uncompressedStarts []int64, err error) {
+	// Read stream header and footer, which should have the same stream flags
+	header := make([]byte, xzStreamHeaderSize)
+	in.Seek(0, io.SeekStart)
+	if _, err = io.ReadFull(in, header); err != nil {
+		return nil, nil, err
+	}
+	footer := make([]byte, xzStreamFooterSize)
+	in.Seek(size-xzStreamFooterSize, io.SeekStart)
+	if _, err = io.ReadFull(in, footer); err != nil {
+		return nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(header[8:12]) != crc32.ChecksumIEEE(header[6:8]) || binary.LittleEndian.Uint32(footer[0:4]) != crc32.ChecksumIEEE(footer[4:10]) {
+		return nil, nil, errors.New("xz stream header or footer is corrupted")
+	}
+	if !bytes.Equal(header[6:8], footer[8:10]) {
+		return nil, nil, errors.New("xz stream header and footer don't match")
+	}
+
+	// Read index
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > size-xzStreamHeaderSize-xzStreamFooterSize {
+		return nil, nil, errors.New("xz index is larger than file; file may be corrupted")
+	}
+	index := make([]byte, indexSize)
+	in.Seek(size-xzStreamFooterSize-indexSize, io.SeekStart)
+	if _, err = io.ReadFull(in, index); err != nil {
+		return nil, nil, err
+	}
+	if index[0] != 0 || binary.LittleEndian.Uint32(index[indexSize-4:]) != crc32.ChecksumIEEE(index[:indexSize-4]) {
+		return nil, nil, errors.New("Invalid xz index")
+	}
+
+	// Decode records
+	numRecords, length, err := readXzVarint(index[1 : indexSize-4])
+	if err != nil {
+		return nil, nil, err
+	}
+	records := index[1+length : indexSize-4]
+	if numRecords > uint64(len(records)/2) {
+		return nil, nil, errors.New("Invalid xz index")
+	}
+	blockStarts = make([]int64, numRecords+1)
+	uncompressedStarts = make([]int64, numRecords+1)
+	blockStarts[0] = xzStreamHeaderSize
+	for i := uint64(0); i < numRecords; i++ {
+		unpaddedSize, length, err := readXzVarint(records)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = records[length:]
+		uncompressedSize, length, err := readXzVarint(records)
+		if err != nil {
+			return nil, nil, err
+		}
+		records = records[length:]
+		blockStarts[i+1] = blockStarts[i] + int64(unpaddedSize+3)/4*4
+		uncompressedStarts[i+1] = uncompressedStarts[i] + int64(uncompressedSize)
+	}
+	if blockStarts[numRecords] != size-xzStreamFooterSize-indexSize {
+		return nil, nil, errors.New("Sizes of blocks in xz index don't add up to the file size (files with more than one xz stream aren't supported)")
+	}
+	if numRecords > 0 {
+		blockStarts[0] = 0
+	}
+	return blockStarts, uncompressedStarts, nil
+}
+
+// Initializes decompressor for an xz file without block data
+func (d *Decompressor) initXz(c *Compression, in io.ReadSeeker, size int64) error {
+	var err error
+	d.blockStarts, d.uncompressedStarts, err = readXzIndex(in, size)
+	if err != nil {
+		return err
+	}
+	preferBinary := c.PreferBinary
+	d.c, err = newCompression(XZ, c.BlockSize, c.HeuristicBytes, c.NumThreads, c.MaxCompressionRatio)
+	if err != nil {
+		return err
+	}
+	d.c.PreferBinary = preferBinary
+	d.numBlocks = uint64(len(d.blockStarts) - 1)
+	d.decompressedSize = d.uncompressedStarts[d.numBlocks]
+	d.blockFlags = nil
+	d.checksums = nil
+	d.zstdChecksums = nil
+	d.hashes = make(map[HashType][]byte)
+	d.metadata = nil
+
+	// Initialize cursor position and copy over reader
+	d.cursorPos = new(int64)
+	in.Seek(0, io.SeekStart)
+	d.in = in
+	return nil
+}
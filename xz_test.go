@@ -0,0 +1,151 @@
+package press
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// Checks that a file is a plain xz file of data, using the xz binary too if it exists
+func checkXzFile(t *testing.T, compressed []byte, data []byte) {
+	xzReader, err := xz.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(xzReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Compressed file isn't a plain xz file of the original data")
+	}
+	if binPath, err := exec.LookPath(XZCommand); err == nil {
+		cmd := exec.Command(binPath, "-dc")
+		cmd.Stdin = bytes.NewReader(compressed)
+		decompressed, err = cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatal("Data decompressed by xz binary doesn't match original data")
+		}
+	}
+}
+
+var xzModeTest = containerModeTest{"xz", 100000, XZ, checkXzFile}
+
+func TestXzEmptyFile(t *testing.T) {
+	comp, err := NewCompressionPreset("xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	if err = comp.CompressFile(bytes.NewReader(nil), 0, &compressed); err != nil {
+		t.Fatal(err)
+	}
+	checkXzFile(t, compressed.Bytes(), nil)
+}
+
+func TestAppendToEmptyXz(t *testing.T) {
+	// The xz binary writes files without blocks for empty input
+	empty := append(xzStreamHeader(xzCheckType), xzIndexAndFooter(nil, nil, xzCheckType)...)
+	if binPath, err := exec.LookPath(XZCommand); err == nil {
+		fromBinary, err := exec.Command(binPath, "-c").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(fromBinary, empty) {
+			t.Fatal("Empty xz file doesn't match the one the xz binary writes")
+		}
+	}
+	d, err := Open(bytes.NewReader(empty), int64(len(empty)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.numBlocks != 0 {
+		t.Fatalf("Empty xz file opened with %d blocks", d.numBlocks)
+	}
+
+	// Appending should compress only the new data
+	comp, err := NewCompressionPreset("xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(300000)
+	var appended bytes.Buffer
+	err = comp.AppendFile(bytes.NewReader(empty), int64(len(empty)), bytes.NewReader(data), &appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkXzFile(t, appended.Bytes(), data)
+	checkContainerOpen(t, xzModeTest, appended.Bytes(), data)
+}
+
+func TestThirdPartyXz(t *testing.T) {
+	// Multi-block xz files with each type of check
+	data := makeTestData(500000)
+	for _, checkType := range []byte{xz.None, xz.CRC32, xz.CRC64, xz.SHA256} {
+		var compressed bytes.Buffer
+		xzWriter, err := xz.WriterConfig{BlockSize: 65536, CheckSum: checkType, NoCheckSum: checkType == xz.None}.NewWriter(&compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xzWriter.Write(data)
+		if err = xzWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		d, err := Open(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.c.CompressionMode != XZ || d.numBlocks < 2 {
+			t.Fatalf("Opened as mode %d with %d blocks", d.c.CompressionMode, d.numBlocks)
+		}
+		checkRandomAccess(t, d, data)
+
+		// Only files with CRC64 checks can be appended to, since every block of an xz file has the same type of check
+		if checkType != xz.CRC64 {
+			comp, err := NewCompressionPreset("xz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = comp.AppendFile(bytes.NewReader(compressed.Bytes()), int64(compressed.Len()), bytes.NewReader(data[:100000]), ioutil.Discard)
+			if err == nil {
+				t.Fatalf("Appending to an xz file with check type %d should fail", checkType)
+			}
+			continue
+		}
+		checkContainerAppend(t, xzModeTest, compressed.Bytes(), data)
+
+		// A corrupted block should be caught by its check
+		corrupted := append([]byte{}, compressed.Bytes()...)
+		corrupted[d.blockStarts[1]-2] ^= 0xff
+		d, err = Open(bytes.NewReader(corrupted), int64(len(corrupted)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ioutil.ReadAll(d); err == nil {
+			t.Fatal("Reading a corrupted xz block should fail")
+		}
+	}
+
+	// Files written by the multithreaded xz binary store sizes in their block headers
+	binPath, err := exec.LookPath(XZCommand)
+	if err != nil {
+		t.Skip("xz binary not found")
+	}
+	cmd := exec.Command(binPath, "-c", "-1", "-T2", "--block-size=65536")
+	cmd.Stdin = bytes.NewReader(data)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+}
@@ -0,0 +1,143 @@
+package press
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/id01/rclone-compression/format"
+)
+
+/*** ZSTD SEEKABLE FORMAT ***/
+// See https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md.
+// A seekable zstd file is a series of independent zstd frames followed by a seek table in a skippable frame:
+// * uint32 skippable frame magic number, uint32 size of the rest of the skippable frame
+// * for each frame: uint32 compressed size, uint32 decompressed size, and (if the checksum flag is set) the low 32 bits
+//   of the XXH64 of the decompressed frame
+// * uint32 number of frames, uint8 seek table descriptor, uint32 seekable magic number
+// All numbers are little endian. Files compressed in ZSTD_SEEKABLE mode are genuine seekable zstd files, so block data
+// and footer are only written to a sidecar index. Their frames have their own content checksums, so the seek table doesn't.
+const zstdSkippableMagicNumber = 0x184d2a5e
+const zstdSeekableMagicNumber = 0x8f92eab1
+const zstdSkippableHeaderSize = 8
+const zstdSeekTableFooterSize = 9
+
+// Seek table descriptor flags
+const zstdSeekTableChecksumFlag = 0x80
+const zstdSeekTableReservedBits = 0x7c
+
+// Writes the seek table of blocks
+func writeZstdSeekTable(out io.Writer, idx *format.Index) error {
+	if uint64(len(idx.BlockSizes)) > 0xffffffff {
+		return errors.New("Too many blocks for a zstd seek table")
+	}
+	table := make([]byte, 0, zstdSkippableHeaderSize+8*len(idx.BlockSizes)+zstdSeekTableFooterSize)
+	table = binary.LittleEndian.AppendUint32(table, zstdSkippableMagicNumber)
+	table = binary.LittleEndian.AppendUint32(table, uint32(8*len(idx.BlockSizes)+zstdSeekTableFooterSize))
+	for i, blockSize := range idx.BlockSizes {
+		if blockSize > 0xffffffff || idx.UncompressedSizes[i] > 0xffffffff {
+			return errors.New("Block is too large for a zstd seek table")
+		}
+		table = binary.LittleEndian.AppendUint32(table, uint32(blockSize))
+		table = binary.LittleEndian.AppendUint32(table, uint32(idx.UncompressedSizes[i]))
+	}
+	table = binary.LittleEndian.AppendUint32(table, uint32(len(idx.BlockSizes)))
+	table = append(table, 0)
+	table = binary.LittleEndian.AppendUint32(table, zstdSeekableMagicNumber)
+	_, err := out.Write(table)
+	return err
+}
+
+// Whether a file ends with a zstd seek table
+func hasZstdSeekTable(in io.ReadSeeker, size int64) bool {
+	if size < zstdSkippableHeaderSize+zstdSeekTableFooterSize {
+		return false
+	}
+	magic := make([]byte, 4)
+	in.Seek(size-4, io.SeekStart)
+	_, err := io.ReadFull(in, magic)
+	return err == nil && binary.LittleEndian.Uint32(magic) == zstdSeekableMagicNumber
+}
+
+// Reads the seek table at the end of a seekable zstd file. Returns the compressed and uncompressed start of each frame
+// (ending with the end of the last frame), and the checksum of each frame if the seek table has them.
+func readZstdSeekTable(in io.ReadSeeker, size int64) (blockStarts []int64, uncompressedStarts []int64, checksums []uint32, err error) {
+	// Read footer
+	footer := make([]byte, zstdSeekTableFooterSize)
+	in.Seek(size-zstdSeekTableFooterSize, io.SeekStart)
+	if _, err = io.ReadFull(in, footer); err != nil {
+		return nil, nil, nil, err
+	}
+	numFrames := int64(binary.LittleEndian.Uint32(footer[0:4]))
+	descriptor := footer[4]
+	if descriptor&zstdSeekTableReservedBits != 0 {
+		return nil, nil, nil, errors.New("Reserved bits of zstd seek table descriptor are set")
+	}
+	entrySize := int64(8)
+	if descriptor&zstdSeekTableChecksumFlag != 0 {
+		entrySize = 12
+	}
+
+	// Read the seek table, and check its skippable frame header
+	tableSize := zstdSkippableHeaderSize + numFrames*entrySize + zstdSeekTableFooterSize
+	if tableSize > size {
+		return nil, nil, nil, errors.New("zstd seek table is larger than file; file may be corrupted")
+	}
+	table := make([]byte, tableSize-zstdSeekTableFooterSize)
+	in.Seek(size-tableSize, io.SeekStart)
+	if _, err = io.ReadFull(in, table); err != nil {
+		return nil, nil, nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:4]) != zstdSkippableMagicNumber || int64(binary.LittleEndian.Uint32(table[4:8])) != tableSize-zstdSkippableHeaderSize {
+		return nil, nil, nil, errors.New("zstd seek table isn't in a skippable frame")
+	}
+
+	// Decode entries
+	blockStarts = make([]int64, numFrames+1)
+	uncompressedStarts = make([]int64, numFrames+1)
+	if entrySize == 12 {
+		checksums = make([]uint32, numFrames)
+	}
+	for i, entry := int64(0), table[zstdSkippableHeaderSize:]; i < numFrames; i, entry = i+1, entry[entrySize:] {
+		blockStarts[i+1] = blockStarts[i] + int64(binary.LittleEndian.Uint32(entry[0:4]))
+		uncompressedStarts[i+1] = uncompressedStarts[i] + int64(binary.LittleEndian.Uint32(entry[4:8]))
+		if checksums != nil {
+			checksums[i] = binary.LittleEndian.Uint32(entry[8:12])
+		}
+	}
+	if blockStarts[numFrames] != size-tableSize {
+		return nil, nil, nil, errors.New("Sizes of frames in zstd seek table don't add up to the file size")
+	}
+	return blockStarts, uncompressedStarts, checksums, nil
+}
+
+// Checksum of a decompressed frame in a zstd seek table
+func zstdSeekTableChecksum(block []byte) uint32 {
+	return uint32(xxhash.Sum64(block))
+}
+
+// Initializes decompressor for a seekable zstd file without block data
+func (d *Decompressor) initZstdSeekable(c *Compression, in io.ReadSeeker, size int64) error {
+	var err error
+	d.blockStarts, d.uncompressedStarts, d.zstdChecksums, err = readZstdSeekTable(in, size)
+	if err != nil {
+		return err
+	}
+	d.c, err = newCompression(ZSTD_SEEKABLE, c.BlockSize, c.HeuristicBytes, c.NumThreads, c.MaxCompressionRatio)
+	if err != nil {
+		return err
+	}
+	d.numBlocks = uint64(len(d.blockStarts) - 1)
+	d.decompressedSize = d.uncompressedStarts[d.numBlocks]
+	d.blockFlags = nil
+	d.checksums = nil
+	d.hashes = make(map[HashType][]byte)
+	d.metadata = nil
+
+	// Initialize cursor position and copy over reader
+	d.cursorPos = new(int64)
+	in.Seek(0, io.SeekStart)
+	d.in = in
+	return nil
+}
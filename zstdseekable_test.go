@@ -0,0 +1,126 @@
+package press
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Checks that a file is a plain zstd stream of data (the seek table is in a skippable frame), using the zstd binary too if it exists
+func checkZstdSeekableFile(t *testing.T, compressed []byte, data []byte) {
+	decoder, err := zstd.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(decoder)
+	decoder.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, data) {
+		t.Fatal("Compressed file isn't a plain zstd stream of the original data")
+	}
+	if binPath, err := exec.LookPath("zstd"); err == nil {
+		cmd := exec.Command(binPath, "-dc")
+		cmd.Stdin = bytes.NewReader(compressed)
+		decompressed, err = cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decompressed, data) {
+			t.Fatal("Data decompressed by zstd binary doesn't match original data")
+		}
+	}
+}
+
+var zstdSeekableModeTest = containerModeTest{"zstd-seekable", 100000, ZSTD_SEEKABLE, checkZstdSeekableFile}
+
+// Creates a seekable zstd file like the reference implementation does with checksums: frames without content checksums,
+// and checksums in the seek table
+func makeThirdPartyZstdSeekable(t *testing.T, data []byte, frameSize int) []byte {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderCRC(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	var file bytes.Buffer
+	var entries []byte
+	numFrames := 0
+	for start := 0; start < len(data); start += frameSize {
+		end := start + frameSize
+		if end > len(data) {
+			end = len(data)
+		}
+		frame := encoder.EncodeAll(data[start:end], nil)
+		file.Write(frame)
+		entries = binary.LittleEndian.AppendUint32(entries, uint32(len(frame)))
+		entries = binary.LittleEndian.AppendUint32(entries, uint32(end-start))
+		entries = binary.LittleEndian.AppendUint32(entries, uint32(xxhash.Sum64(data[start:end])))
+		numFrames++
+	}
+	file.Write(binary.LittleEndian.AppendUint32(nil, zstdSkippableMagicNumber))
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(entries) + zstdSeekTableFooterSize)))
+	file.Write(entries)
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(numFrames)))
+	file.WriteByte(zstdSeekTableChecksumFlag)
+	file.Write(binary.LittleEndian.AppendUint32(nil, zstdSeekableMagicNumber))
+	return file.Bytes()
+}
+
+func TestThirdPartyZstdSeekable(t *testing.T) {
+	data := makeTestData(500000)
+	compressed := makeThirdPartyZstdSeekable(t, data, 65536)
+	d, err := Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRandomAccess(t, d, data)
+
+	// A wrong checksum in the seek table should be caught
+	compressed[len(compressed)-zstdSeekTableFooterSize-1] ^= 0xff
+	d, err = Open(bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ioutil.ReadAll(d)
+	if checksumErr, ok := err.(*ChecksumError); !ok || checksumErr.Block != d.numBlocks-1 {
+		t.Fatalf("Expected ChecksumError for the last block, got %v", err)
+	}
+
+	// So should a seek table that doesn't match the file
+	compressed = makeThirdPartyZstdSeekable(t, data, 65536)
+	if _, err = Open(bytes.NewReader(compressed[1:]), int64(len(compressed)-1)); err == nil {
+		t.Fatal("Opening a file that doesn't match its seek table should fail")
+	}
+}
+
+func TestAppendToEmptyZstdSeekable(t *testing.T) {
+	// A seekable zstd file without frames is just a seek table
+	empty := makeThirdPartyZstdSeekable(t, nil, 65536)
+	d, err := Open(bytes.NewReader(empty), int64(len(empty)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.numBlocks != 0 {
+		t.Fatalf("Empty seekable zstd file opened with %d blocks", d.numBlocks)
+	}
+
+	// Appending should compress only the new data
+	comp, err := NewCompressionPreset("zstd-seekable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := makeTestData(300000)
+	var appended bytes.Buffer
+	err = comp.AppendFile(bytes.NewReader(empty), int64(len(empty)), bytes.NewReader(data), &appended)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkZstdSeekableFile(t, appended.Bytes(), data)
+	checkContainerOpen(t, zstdSeekableModeTest, appended.Bytes(), data)
+}